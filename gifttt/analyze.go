@@ -0,0 +1,217 @@
+package gifttt
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/drtoful/gifttt/Godeps/_workspace/src/github.com/drtoful/twik"
+	"github.com/drtoful/gifttt/Godeps/_workspace/src/github.com/drtoful/twik/ast"
+)
+
+// names that are bound locally in a rule, mirroring the scopes twik
+// creates while evaluating it
+type locals struct {
+	names  map[string]bool
+	parent *locals
+	// set for the scope of the action given to "after", which is
+	// evaluated later without the scopes around it
+	after ast.Pos
+}
+
+func (l *locals) branch() *locals {
+	return &locals{names: make(map[string]bool), parent: l}
+}
+
+func (l *locals) bound(name string) bool {
+	for ; l != nil; l = l.parent {
+		if l.names[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the actions of "after" the local name is used in, but bound
+// outside of
+func (l *locals) crossed(name string) []ast.Pos {
+	actions := []ast.Pos{}
+	for ; l != nil; l = l.parent {
+		if l.names[name] {
+			return actions
+		}
+		if l.after != 0 {
+			actions = append(actions, l.after)
+		}
+	}
+	return nil
+}
+
+// the analyzer tries to find out, which symbols (in gifttt variables)
+// a rule reads and thus might trigger it on value change, and which it
+// writes with "set". Symbols that are bound locally with "var", "func",
+// "for" and "range" are neither.
+type analyzer struct {
+	reads  map[string]bool
+	writes map[string]bool
+	// the local names used by the actions of "after", by the position of
+	// the action
+	captures map[ast.Pos][]string
+}
+
+func newAnalyzer(node ast.Node) *analyzer {
+	a := &analyzer{
+		reads:    make(map[string]bool),
+		writes:   make(map[string]bool),
+		captures: make(map[ast.Pos][]string),
+	}
+	a.eval(node, (&locals{}).branch())
+	return a
+}
+
+// returns the variables read and written by the program of a rule
+func analyze(node ast.Node) (reads []string, writes []string) {
+	a := newAnalyzer(node)
+	return sortedKeys(a.reads), sortedKeys(a.writes)
+}
+
+// returns the local names used by the actions of "after" in the program,
+// which have to be kept with the action as they are not bound anymore
+// once the action is evaluated
+func captures(node ast.Node) map[ast.Pos][]string {
+	return newAnalyzer(node).captures
+}
+
+// remembers that the local name is used by the actions
+func (a *analyzer) capture(name string, actions []ast.Pos) {
+	for _, pos := range actions {
+		found := false
+		for _, n := range a.captures[pos] {
+			found = found || n == name
+		}
+		if !found {
+			a.captures[pos] = append(a.captures[pos], name)
+		}
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func isGlobal(name string) bool {
+	if _, ok := builtins[name]; ok {
+		return true
+	}
+	if _, ok := (&GlobalScope{}).functions()[name]; ok {
+		return true
+	}
+	for _, glb := range twik.Globals {
+		if name == glb.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *analyzer) evalAll(nodes []ast.Node, scope *locals) {
+	for _, node := range nodes {
+		a.eval(node, scope)
+	}
+}
+
+// binds the symbol (if it is one) in the given scope
+func bind(node ast.Node, scope *locals) {
+	if symbol, ok := node.(*ast.Symbol); ok {
+		scope.names[symbol.Name] = true
+	}
+}
+
+func (a *analyzer) eval(node ast.Node, scope *locals) {
+	switch node := node.(type) {
+	case *ast.Symbol:
+		// keywords (e.g. ":timeout") are never variables
+		if strings.HasPrefix(node.Name, ":") {
+			return
+		}
+		if scope.bound(node.Name) {
+			a.capture(node.Name, scope.crossed(node.Name))
+			return
+		}
+		if isGlobal(node.Name) {
+			return
+		}
+		a.reads[node.Name] = true
+	case *ast.Root:
+		a.evalAll(node.Nodes, scope)
+	case *ast.List:
+		if len(node.Nodes) == 0 {
+			return
+		}
+
+		args := node.Nodes[1:]
+		fn, ok := node.Nodes[0].(*ast.Symbol)
+		if !ok || scope.bound(fn.Name) {
+			a.evalAll(node.Nodes, scope)
+			return
+		}
+
+		switch {
+		case fn.Name == "var" && len(args) > 0:
+			a.evalAll(args[1:], scope)
+			bind(args[0], scope)
+		case fn.Name == "set" && len(args) > 0:
+			a.evalAll(args[1:], scope)
+			if target, ok := args[0].(*ast.Symbol); ok {
+				if scope.bound(target.Name) {
+					a.capture(target.Name, scope.crossed(target.Name))
+				} else {
+					a.writes[target.Name] = true
+				}
+			}
+		case fn.Name == "do":
+			a.evalAll(args, scope.branch())
+		case fn.Name == "func" && len(args) > 0:
+			if _, ok := args[0].(*ast.Symbol); ok {
+				bind(args[0], scope)
+				args = args[1:]
+			}
+
+			body := scope.branch()
+			if len(args) > 0 {
+				if params, ok := args[0].(*ast.List); ok {
+					for _, param := range params.Nodes {
+						bind(param, body)
+					}
+					args = args[1:]
+				}
+			}
+			a.evalAll(args, body)
+		case fn.Name == "after" && len(args) > 0:
+			action := args[len(args)-1]
+			a.evalAll(args[:len(args)-1], scope)
+			body := scope.branch()
+			body.after = action.Pos()
+			a.eval(action, body)
+		case fn.Name == "for":
+			a.evalAll(args, scope.branch())
+		case fn.Name == "range" && len(args) > 1:
+			body := scope.branch()
+			a.eval(args[1], body)
+			if list, ok := args[0].(*ast.List); ok {
+				for _, n := range list.Nodes {
+					bind(n, body)
+				}
+			} else {
+				bind(args[0], body)
+			}
+			a.evalAll(args[2:], body)
+		default:
+			a.evalAll(args, scope)
+		}
+	}
+}
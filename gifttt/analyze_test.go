@@ -0,0 +1,43 @@
+package gifttt
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/drtoful/gifttt/Godeps/_workspace/src/github.com/drtoful/twik"
+)
+
+func TestAnalyze(t *testing.T) {
+	tests := []struct {
+		source string
+		reads  []string
+		writes []string
+	}{
+		{`(set y x)`, []string{"x"}, []string{"y"}},
+		{`(set light:on (> time:hour 7))`, []string{"time:hour"}, []string{"light:on"}},
+		{`(if (> temp 20) (set fan true) (set fan false))`, []string{"temp"}, []string{"fan"}},
+		{`(http-get url :timeout 5)`, []string{"url"}, []string{}},
+		// locals are neither read nor written
+		{`(var a x) (set y a)`, []string{"x"}, []string{"y"}},
+		{`(var n 0) (set n (+ n x))`, []string{"x"}, []string{}},
+		{`(set y a) (var a x)`, []string{"a", "x"}, []string{"y"}},
+		{`(do (var a 1)) (set y a)`, []string{"a"}, []string{"y"}},
+		{`(func f (p) (+ p q)) (set y (f x))`, []string{"q", "x"}, []string{"y"}},
+		{`(var f (func (p) p)) (set y (f x))`, []string{"x"}, []string{"y"}},
+		{`(range (i v) items (set total v))`, []string{"items"}, []string{"total"}},
+		{`(range i items (set n i))`, []string{"items"}, []string{"n"}},
+		{`(for (var i 0) (< i n) (set i (+ i 1)) (set total i))`, []string{"n"}, []string{"total"}},
+		{`(after "5m" (set light:on false))`, []string{}, []string{"light:on"}},
+	}
+	for _, test := range tests {
+		node, err := twik.Parse(twik.NewFileSet(), "test.rule", []byte(test.source))
+		if err != nil {
+			t.Fatalf("%s: %s", test.source, err.Error())
+		}
+
+		reads, writes := analyze(node)
+		if !reflect.DeepEqual(reads, test.reads) || !reflect.DeepEqual(writes, test.writes) {
+			t.Errorf("%s reads %q and writes %q, expected %q and %q", test.source, reads, writes, test.reads, test.writes)
+		}
+	}
+}
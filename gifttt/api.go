@@ -1,10 +1,19 @@
 package gifttt
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/drtoful/gifttt/Godeps/_workspace/src/github.com/codegangsta/negroni"
+	"github.com/drtoful/gifttt/Godeps/_workspace/src/github.com/drtoful/twik"
+	"github.com/drtoful/gifttt/Godeps/_workspace/src/github.com/drtoful/twik/ast"
 	"github.com/drtoful/gifttt/Godeps/_workspace/src/github.com/gorilla/mux"
 )
 
@@ -13,16 +22,23 @@ type APIServer struct {
 	handler  *negroni.Negroni
 }
 
-var (
-	internalVars = []string{
-		"time:second",
-		"time:minute",
-		"time:hour",
-		"date:day",
-		"date:month",
-		"date:year",
+// variables computed by gifttt itself can not be changed
+func isInternal(varname string) bool {
+	for _, v := range timeVars {
+		if v.name == varname {
+			return true
+		}
 	}
-)
+
+	if rm := GetRuleManager(); rm != nil && rm.Coordinates != nil {
+		for _, name := range sunVars {
+			if name == varname {
+				return true
+			}
+		}
+	}
+	return false
+}
 
 func postVar(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
@@ -30,11 +46,9 @@ func postVar(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	varname := vars["var"]
 
-	for _, c := range internalVars {
-		if c == varname {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
+	if isInternal(varname) {
+		w.WriteHeader(http.StatusForbidden)
+		return
 	}
 
 	var value Value
@@ -78,13 +92,488 @@ func getVar(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+func deleteVar(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	varname := vars["var"]
+
+	if isInternal(varname) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	vm := GetManager()
+	err := vm.Delete(varname)
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusOK)
+	case ErrNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+	}
+}
+
+// lists all variables, optionally only those starting with the prefix
+// given in the query string
+func listVars(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+
+	vm := GetManager()
+	values, err := vm.List(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, values)
+}
+
+// times in queries can either be given as unix timestamp or RFC 3339
+func parseTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(i, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// returns the values of a variable between the times given with the
+// "from" and "to" query parameters
+func getHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	varname := vars["var"]
+
+	query := r.URL.Query()
+	from, err := parseTime(query.Get("from"), time.Unix(0, 0))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	to, err := parseTime(query.Get("to"), time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	vm := GetManager()
+	values, err := vm.History(varname, from, to)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, values)
+}
+
+func getRetention(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	varname := vars["var"]
+
+	vm := GetManager()
+	retention, err := vm.Retention(varname)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, retention)
+}
+
+func putRetention(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+	varname := vars["var"]
+
+	var retention Retention
+	if err := json.NewDecoder(r.Body).Decode(&retention); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	vm := GetManager()
+	if err := vm.SetRetention(varname, &retention); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func deleteRetention(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	varname := vars["var"]
+
+	vm := GetManager()
+	if err := vm.SetRetention(varname, nil); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func getType(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	varname := vars["var"]
+
+	vm := GetManager()
+	t, err := vm.Type(varname)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if t == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("variable has no type"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, t)
+}
+
+func putType(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+	varname := vars["var"]
+
+	if isInternal(varname) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var t Type
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	vm := GetManager()
+	if err := vm.SetType(varname, &t); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func deleteType(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	varname := vars["var"]
+
+	vm := GetManager()
+	if err := vm.SetType(varname, nil); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// a single change in the stream of variable changes
+type varEvent struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+// streams all changes of variables as server-sent events. Changes can be
+// restricted to variables matching one of the glob patterns given with
+// the "filter" query parameter (e.g. "sensor:*").
+func streamVars(w http.ResponseWriter, r *http.Request) {
+	filters := r.URL.Query()["filter"]
+	for _, filter := range filters {
+		if _, err := path.Match(filter, ""); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("streaming not supported"))
+		return
+	}
+
+	var closed <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closed = notifier.CloseNotify()
+	}
+
+	vm := GetManager()
+	updates := vm.Subscribe(64)
+	defer vm.Unsubscribe(updates)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// send a comment from time to time, so that proxies don't close
+	// the connection when there are no changes
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-updates.Ready:
+			values, dropped := updates.Take()
+			for _, v := range values {
+				matched := len(filters) == 0
+				for _, filter := range filters {
+					if ok, _ := path.Match(filter, v.Name); ok {
+						matched = true
+						break
+					}
+				}
+				if !matched {
+					continue
+				}
+
+				b, err := json.Marshal(&varEvent{Name: v.Name, Value: v.Value})
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(w, "data: %s\n\n", b)
+			}
+
+			// the client has to load the current values again, as it
+			// has missed some of the changes
+			if dropped > 0 {
+				fmt.Fprintf(w, "event: resync\ndata: {\"dropped\":%d}\n\n", dropped)
+			}
+			flusher.Flush()
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-closed:
+			return
+		}
+	}
+}
+
+// returns the counters of the queue between variable changes and rules
+func getQueue(w http.ResponseWriter, r *http.Request) {
+	vm := GetManager()
+	writeJSON(w, http.StatusOK, vm.Events.Stats())
+}
+
+// returns the pending timers started by rules
+func listTimers(w http.ResponseWriter, r *http.Request) {
+	rm := GetRuleManager()
+	writeJSON(w, http.StatusOK, rm.Timers())
+}
+
+func deleteTimer(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	rm := GetRuleManager()
+	err := rm.CancelTimer(vars["id"])
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusOK)
+	case ErrTimerNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+	}
+}
+
+// the result of validating a rule, including the position of the error
+// in the rule's source if the rule is not valid
+type ruleStatus struct {
+	Valid  bool   `json:"valid"`
+	Error  string `json:"error,omitempty"`
+	Line   int    `json:"line,omitempty"`
+	Column int    `json:"column,omitempty"`
+}
+
+func newRuleStatus(name string, err error) *ruleStatus {
+	if err == nil {
+		return &ruleStatus{Valid: true}
+	}
+
+	status := &ruleStatus{Error: err.Error()}
+	pos := &ast.PosInfo{}
+	if e, ok := err.(*twik.Error); ok {
+		pos = e.PosInfo
+		status.Error = e.Err.Error()
+	} else if strings.HasPrefix(status.Error, name+":") {
+		// the parser only reports the position as part of the error
+		// message in the form "name:line:column: message"
+		parts := strings.SplitN(status.Error[len(name)+1:], ":", 3)
+		if len(parts) == 3 {
+			line, err1 := strconv.Atoi(parts[0])
+			column, err2 := strconv.Atoi(parts[1])
+			if err1 == nil && err2 == nil {
+				pos.Line = line
+				pos.Column = column
+				status.Error = strings.TrimSpace(parts[2])
+			}
+		}
+	}
+
+	status.Line = pos.Line
+	status.Column = pos.Column
+	return status
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// rules are addressed by their file name, the ".rule" suffix is optional
+func ruleName(r *http.Request) string {
+	name := mux.Vars(r)["rule"]
+	if !strings.HasSuffix(name, ".rule") {
+		name = name + ".rule"
+	}
+	return name
+}
+
+func listRules(w http.ResponseWriter, r *http.Request) {
+	rm := GetRuleManager()
+	writeJSON(w, http.StatusOK, rm.Rules())
+}
+
+func getRule(w http.ResponseWriter, r *http.Request) {
+	rm := GetRuleManager()
+	rule, err := rm.Rule(ruleName(r))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(rule.Source()))
+}
+
+func putRule(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	name := ruleName(r)
+	rm := GetRuleManager()
+	if err := rm.Put(name, data); err != nil {
+		writeJSON(w, http.StatusBadRequest, newRuleStatus(name, err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newRuleStatus(name, nil))
+}
+
+func deleteRule(w http.ResponseWriter, r *http.Request) {
+	rm := GetRuleManager()
+	err := rm.Delete(ruleName(r))
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusOK)
+	case ErrRuleNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+	case ErrRuleName:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+	}
+}
+
+// parses the rule in the request body without loading it
+func validateRule(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	name := ruleName(r)
+	if err := checkRuleName(name); err != nil {
+		writeJSON(w, http.StatusBadRequest, newRuleStatus(name, err))
+		return
+	}
+
+	if _, err := NewRule(name, bytes.NewReader(data)); err != nil {
+		writeJSON(w, http.StatusBadRequest, newRuleStatus(name, err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newRuleStatus(name, nil))
+}
+
 func NewAPIServer(ip, port string) *APIServer {
 	router := mux.NewRouter()
 
 	api := router.PathPrefix("/v").Subrouter()
 	api = api.StrictSlash(true)
+	api.Path("/").Methods("GET").HandlerFunc(listVars)
 	api.Path("/{var}").Methods("POST").HandlerFunc(postVar)
 	api.Path("/{var}").Methods("GET").HandlerFunc(getVar)
+	api.Path("/{var}").Methods("DELETE").HandlerFunc(deleteVar)
+	api.Path("/{var}/history").Methods("GET").HandlerFunc(getHistory)
+	api.Path("/{var}/retention").Methods("GET").HandlerFunc(getRetention)
+	api.Path("/{var}/retention").Methods("PUT").HandlerFunc(putRetention)
+	api.Path("/{var}/retention").Methods("DELETE").HandlerFunc(deleteRetention)
+	api.Path("/{var}/type").Methods("GET").HandlerFunc(getType)
+	api.Path("/{var}/type").Methods("PUT").HandlerFunc(putType)
+	api.Path("/{var}/type").Methods("DELETE").HandlerFunc(deleteType)
+
+	router.Path("/events").Methods("GET").HandlerFunc(streamVars)
+	router.Path("/queue").Methods("GET").HandlerFunc(getQueue)
+
+	timers := router.PathPrefix("/timers").Subrouter()
+	timers = timers.StrictSlash(true)
+	timers.Path("/").Methods("GET").HandlerFunc(listTimers)
+	timers.Path("/{id}").Methods("DELETE").HandlerFunc(deleteTimer)
+
+	rules := router.PathPrefix("/r").Subrouter()
+	rules = rules.StrictSlash(true)
+	rules.Path("/").Methods("GET").HandlerFunc(listRules)
+	rules.Path("/{rule}").Methods("GET").HandlerFunc(getRule)
+	rules.Path("/{rule}").Methods("PUT").HandlerFunc(putRule)
+	rules.Path("/{rule}").Methods("DELETE").HandlerFunc(deleteRule)
+	rules.Path("/{rule}/validate").Methods("POST").HandlerFunc(validateRule)
 
 	n := negroni.New(negroni.NewRecovery())
 	n.UseHandler(router)
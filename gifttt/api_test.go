@@ -0,0 +1,249 @@
+package gifttt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/drtoful/gifttt/Godeps/_workspace/src/github.com/drtoful/twik"
+	"github.com/drtoful/gifttt/Godeps/_workspace/src/github.com/drtoful/twik/ast"
+)
+
+// sends a request to the server, returns the status code and body of the
+// response
+func request(t *testing.T, server string, method, path, body string) (int, string) {
+	req, err := http.NewRequest(method, server+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+// variables are changed through the API while rules are dispatched and
+// change variables themselves, run with -race
+func TestAPIConcurrentWrites(t *testing.T) {
+	defer testStore(t)()
+	m, cleanup := testRuleManager(t)
+	defer cleanup()
+	defer testDispatch(m)()
+
+	if err := m.Put("echo.rule", []byte(`(rule :on (x z)) (set y x) (set w z)`)); err != nil {
+		t.Fatal(err)
+	}
+	server := testAPI()
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"x", "z"} {
+		for i := 0; i < 4; i += 1 {
+			wg.Add(1)
+			go func(name string, i int) {
+				defer wg.Done()
+				for j := 0; j < 25; j += 1 {
+					body := fmt.Sprintf(`{"value": %d}`, i*100+j)
+					resp, err := http.Post(server.URL+"/v/"+name, "application/json", strings.NewReader(body))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					resp.Body.Close()
+					if resp.StatusCode != http.StatusOK {
+						t.Errorf("POST /v/%s returned %d", name, resp.StatusCode)
+					}
+				}
+			}(name, i)
+		}
+	}
+	wg.Wait()
+
+	// the rule has been run with the last values
+	vm := GetManager()
+	x, _ := vm.Get("x")
+	z, _ := vm.Get("z")
+	waitFor(t, "y", x)
+	waitFor(t, "w", z)
+}
+
+func TestNewRuleStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status ruleStatus
+	}{
+		{nil, ruleStatus{Valid: true}},
+		{ErrRuleName, ruleStatus{Error: "invalid rule name"}},
+		{errors.New("test.rule:2:13: unexpected )"), ruleStatus{Error: "unexpected )", Line: 2, Column: 13}},
+		// only positions in the rule itself are used
+		{errors.New("other.rule:2:13: unexpected )"), ruleStatus{Error: "other.rule:2:13: unexpected )"}},
+		{errors.New("test.rule: unexpected )"), ruleStatus{Error: "test.rule: unexpected )"}},
+		{&twik.Error{Err: errors.New("undefined symbol: x"), PosInfo: &ast.PosInfo{Line: 3, Column: 5}}, ruleStatus{Error: "undefined symbol: x", Line: 3, Column: 5}},
+	}
+	for _, test := range tests {
+		if status := newRuleStatus("test.rule", test.err); *status != test.status {
+			t.Errorf("%v: %+v, expected %+v", test.err, *status, test.status)
+		}
+	}
+
+	// the position of errors returned by the parser
+	sources := []struct {
+		source string
+		line   int
+		column int
+	}{
+		{"(set x", 1, 7},
+		{"(set x 1)\n  (set y 1))", 2, 13},
+		{"(rule :name) (set x 1)", 1, 7},
+	}
+	for _, test := range sources {
+		_, err := NewRule("test.rule", strings.NewReader(test.source))
+		if status := newRuleStatus("test.rule", err); status.Valid || status.Line != test.line || status.Column != test.column {
+			t.Errorf("%q: %+v, expected line %d and column %d", test.source, *status, test.line, test.column)
+		}
+	}
+}
+
+func TestRuleAPI(t *testing.T) {
+	defer testStore(t)()
+	m, cleanup := testRuleManager(t)
+	defer cleanup()
+	server := testAPI()
+	defer server.Close()
+
+	status := func(body string) ruleStatus {
+		var s ruleStatus
+		if err := json.Unmarshal([]byte(body), &s); err != nil {
+			t.Errorf("%q: %s", body, err.Error())
+		}
+		return s
+	}
+
+	// the suffix of the name is optional
+	if code, body := request(t, server.URL, "PUT", "/r/lights", `(set x 1)`); code != http.StatusOK || !status(body).Valid {
+		t.Errorf("PUT returned %d %s", code, body)
+	}
+	if code, body := request(t, server.URL, "GET", "/r/lights.rule", ""); code != http.StatusOK || body != `(set x 1)` {
+		t.Errorf("GET returned %d %s", code, body)
+	}
+
+	code, body := request(t, server.URL, "PUT", "/r/lights", "(set x 1)\n(set y")
+	if s := status(body); code != http.StatusBadRequest || s.Valid || s.Error != "missing )" || s.Line != 2 || s.Column != 7 {
+		t.Errorf("PUT of an invalid rule returned %d %s", code, body)
+	}
+	if code, body := request(t, server.URL, "GET", "/r/lights", ""); code != http.StatusOK || body != `(set x 1)` {
+		t.Errorf("GET returned %d %s after an invalid PUT", code, body)
+	}
+
+	// validating a rule does not load it
+	if code, body := request(t, server.URL, "POST", "/r/heating/validate", `(set y 1)`); code != http.StatusOK || !status(body).Valid {
+		t.Errorf("validate returned %d %s", code, body)
+	}
+	code, body = request(t, server.URL, "POST", "/r/heating/validate", `(rule :priority "high")`)
+	if s := status(body); code != http.StatusBadRequest || s.Valid || s.Line != 1 || s.Column != 17 {
+		t.Errorf("validate of an invalid rule returned %d %s", code, body)
+	}
+	if _, err := m.Rule("heating.rule"); err != ErrRuleNotFound {
+		t.Error("validated rule has been loaded")
+	}
+
+	if code, body := request(t, server.URL, "DELETE", "/r/lights", ""); code != http.StatusOK {
+		t.Errorf("DELETE returned %d %s", code, body)
+	}
+	for _, method := range []string{"GET", "DELETE"} {
+		if code, body := request(t, server.URL, method, "/r/lights", ""); code != http.StatusNotFound {
+			t.Errorf("%s of a deleted rule returned %d %s", method, code, body)
+		}
+	}
+
+	// rule names can not leave the rule directory
+	for _, path := range []string{"/r/..%2Fescaped", "/r/..%5Cescaped", "/r/.escaped", "/r/%2E%2E%2Fescaped/validate"} {
+		for _, method := range []string{"PUT", "POST"} {
+			if code, body := request(t, server.URL, method, path, `(set x 1)`); code == http.StatusOK {
+				t.Errorf("%s %s returned %d %s", method, path, code, body)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(m.path, "..", "escaped.rule")); !os.IsNotExist(err) {
+		t.Error("rule has been written outside the rule directory")
+	}
+	if rules := m.Rules(); len(rules) != 0 {
+		t.Errorf("loaded %v", rules)
+	}
+}
+
+func TestVariableAPI(t *testing.T) {
+	defer testStore(t)()
+	server := testAPI()
+	defer server.Close()
+
+	vm := GetManager()
+	for name, value := range map[string]interface{}{"door:front": "open", "door:back": "closed", "light": true} {
+		if err := vm.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := vm.SetRetention("light", &Retention{Count: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path   string
+		values map[string]interface{}
+	}{
+		{"/v/", map[string]interface{}{"door:front": "open", "door:back": "closed", "light": true}},
+		{"/v/?prefix=door:", map[string]interface{}{"door:front": "open", "door:back": "closed"}},
+		{"/v/?prefix=door:f", map[string]interface{}{"door:front": "open"}},
+		{"/v/?prefix=window", map[string]interface{}{}},
+	}
+	for _, test := range tests {
+		code, body := request(t, server.URL, "GET", test.path, "")
+		values := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(body), &values); err != nil || code != http.StatusOK {
+			t.Errorf("GET %s returned %d %s", test.path, code, body)
+			continue
+		}
+		if !reflect.DeepEqual(values, test.values) {
+			t.Errorf("GET %s returned %v, expected %v", test.path, values, test.values)
+		}
+	}
+
+	if code, body := request(t, server.URL, "DELETE", "/v/light", ""); code != http.StatusOK {
+		t.Errorf("DELETE returned %d %s", code, body)
+	}
+	if value, err := vm.Get("light"); value != nil || err != nil {
+		t.Errorf("deleted variable is %v (%v)", value, err)
+	}
+	if values, err := vm.History("light", time.Time{}, time.Now()); err != nil || len(values) != 0 {
+		t.Errorf("history of the deleted variable is %v (%v)", values, err)
+	}
+	if code, body := request(t, server.URL, "GET", "/v/", ""); code != http.StatusOK || strings.Contains(body, "light") {
+		t.Errorf("GET returned %d %s after DELETE", code, body)
+	}
+
+	if code, body := request(t, server.URL, "DELETE", "/v/light", ""); code != http.StatusNotFound {
+		t.Errorf("DELETE of a deleted variable returned %d %s", code, body)
+	}
+	if code, body := request(t, server.URL, "DELETE", "/v/window", ""); code != http.StatusNotFound {
+		t.Errorf("DELETE of an unknown variable returned %d %s", code, body)
+	}
+	if code, body := request(t, server.URL, "DELETE", "/v/time:hour", ""); code != http.StatusForbidden {
+		t.Errorf("DELETE of an internal variable returned %d %s", code, body)
+	}
+}
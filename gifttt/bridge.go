@@ -0,0 +1,360 @@
+package gifttt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the longest time to wait before connecting to the broker again
+	maxReconnectDelay = time.Minute
+
+	// the origin of the changes made by the bridge
+	mqttOrigin = "mqtt"
+)
+
+// MQTTConfig configures the bridge between a MQTT broker and the
+// variables of gifttt
+type MQTTConfig struct {
+	// the broker as "tcp://host:port" or "tls://host:port"
+	Broker   string `json:"broker"`
+	ClientId string `json:"client_id"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// in seconds
+	KeepAlive int `json:"keepalive"`
+
+	Subscribe []*TopicMapping `json:"subscribe"`
+	Publish   []*TopicMapping `json:"publish"`
+}
+
+// A TopicMapping maps messages on topics to variables (when subscribing)
+// or changes of variables to topics (when publishing). Topics can contain
+// the wildcards + and #, variables *. The parts matched by the wildcards
+// can be used with $1, $2, ... in the variable or topic they are mapped
+// to.
+type TopicMapping struct {
+	Topic    string `json:"topic"`
+	Variable string `json:"variable"`
+	// the QoS to subscribe with (0 or 1)
+	QoS    byte `json:"qos"`
+	Retain bool `json:"retain"`
+}
+
+// MQTTBridge sets variables to the messages received from the broker,
+// and publishes the changes of variables to it
+type MQTTBridge struct {
+	config *MQTTConfig
+
+	// connects to the broker
+	dial func(broker string) (net.Conn, error)
+
+	lock   *sync.Mutex
+	client *mqttClient
+}
+
+func LoadMQTTConfig(path string) (*MQTTConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &MQTTConfig{
+		ClientId:  "gifttt",
+		KeepAlive: 60,
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	if config.Broker == "" {
+		return nil, fmt.Errorf("%s: missing broker", path)
+	}
+	if config.KeepAlive <= 0 || config.KeepAlive > 65535 {
+		return nil, fmt.Errorf("%s: keepalive has to be within 1 and 65535 seconds", path)
+	}
+	for _, m := range config.Subscribe {
+		if err := checkTopic(m.Topic); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+		if m.Variable == "" {
+			return nil, fmt.Errorf("%s: missing variable for topic '%s'", path, m.Topic)
+		}
+		if m.QoS > 1 {
+			return nil, fmt.Errorf("%s: qos of topic '%s' has to be 0 or 1", path, m.Topic)
+		}
+	}
+	for _, m := range config.Publish {
+		if m.Variable == "" || m.Topic == "" {
+			return nil, fmt.Errorf("%s: publishing needs a variable and a topic", path)
+		}
+		if strings.ContainsAny(m.Topic, "+#") {
+			return nil, fmt.Errorf("%s: can not publish to topic '%s' with wildcards", path, m.Topic)
+		}
+	}
+	return config, nil
+}
+
+// wildcards have to take up a whole level of the topic, # has to be the
+// last one
+func checkTopic(topic string) error {
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && len(level) != 1 {
+			return fmt.Errorf("invalid wildcard in topic '%s'", topic)
+		}
+		if level == "#" && i != len(levels)-1 {
+			return fmt.Errorf("# has to be the last level of topic '%s'", topic)
+		}
+	}
+	if topic == "" {
+		return errors.New("missing topic")
+	}
+	return nil
+}
+
+// matches a topic against a pattern with wildcards, returns the parts
+// matched by them
+func matchTopic(pattern, topic string) ([]string, bool) {
+	patterns := strings.Split(pattern, "/")
+	levels := strings.Split(topic, "/")
+
+	captures := []string{}
+	for i, p := range patterns {
+		if p == "#" {
+			return append(captures, strings.Join(levels[i:], "/")), true
+		}
+		if i >= len(levels) {
+			return nil, false
+		}
+		if p == "+" {
+			captures = append(captures, levels[i])
+		} else if p != levels[i] {
+			return nil, false
+		}
+	}
+	return captures, len(patterns) == len(levels)
+}
+
+// matches a variable name against a pattern where * matches any text,
+// returns the parts matched by them
+func matchVariable(pattern, name string) ([]string, bool) {
+	i := strings.Index(pattern, "*")
+	if i < 0 {
+		return []string{}, pattern == name
+	}
+	if !strings.HasPrefix(name, pattern[:i]) {
+		return nil, false
+	}
+
+	rest := name[i:]
+	for j := 0; j <= len(rest); j += 1 {
+		if captures, ok := matchVariable(pattern[i+1:], rest[j:]); ok {
+			return append([]string{rest[:j]}, captures...), true
+		}
+	}
+	return nil, false
+}
+
+// replaces $1, $2, ... in the template with the captures
+func expand(template string, captures []string) string {
+	for i := len(captures); i > 0; i -= 1 {
+		template = strings.Replace(template, "$"+strconv.Itoa(i), captures[i-1], -1)
+	}
+	return template
+}
+
+// the value of a message, which is either JSON or a plain string
+func decodePayload(payload []byte) interface{} {
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return string(payload)
+	}
+	return value
+}
+
+// strings are published as they are, so that they are decoded the same
+// way when received
+func encodePayload(value interface{}) ([]byte, error) {
+	if s, ok := value.(string); ok {
+		return []byte(s), nil
+	}
+	return json.Marshal(value)
+}
+
+func NewMQTTBridge(config *MQTTConfig) *MQTTBridge {
+	return &MQTTBridge{
+		config: config,
+		dial:   dialMQTT,
+		lock:   &sync.Mutex{},
+	}
+}
+
+// Run keeps the bridge connected to the broker, reconnecting if the
+// connection is lost
+func (b *MQTTBridge) Run() {
+	if len(b.config.Publish) > 0 {
+		go b.publish(GetManager().SubscribeLatest())
+	}
+
+	delay := time.Second
+	for {
+		start := time.Now()
+		err := b.session()
+		log.Printf("mqtt: connection to %s lost: %s\n", b.config.Broker, err.Error())
+
+		if time.Since(start) > maxReconnectDelay {
+			delay = time.Second
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// connects to the broker and handles its messages until the connection
+// is lost
+func (b *MQTTBridge) session() error {
+	conn, err := b.dial(b.config.Broker)
+	if err != nil {
+		return err
+	}
+
+	keepalive := time.Duration(b.config.KeepAlive) * time.Second
+	client := newMQTTClient(conn)
+	defer client.disconnect()
+
+	conn.SetDeadline(time.Now().Add(mqttDialTimeout))
+	if err := client.connect(b.config.ClientId, b.config.Username, b.config.Password, keepalive); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	client.timeout = keepalive * 3 / 2
+
+	if len(b.config.Subscribe) > 0 {
+		topics, qos := []string{}, []byte{}
+		for _, m := range b.config.Subscribe {
+			topics = append(topics, m.Topic)
+			qos = append(qos, m.QoS)
+		}
+		if err := client.subscribe(topics, qos); err != nil {
+			return err
+		}
+	}
+	log.Printf("mqtt: connected to %s\n", b.config.Broker)
+
+	b.lock.Lock()
+	b.client = client
+	b.lock.Unlock()
+	defer func() {
+		b.lock.Lock()
+		b.client = nil
+		b.lock.Unlock()
+	}()
+
+	// the broker drops us if it does not hear from us within the
+	// keepalive, and we drop it if it does not answer our pings
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(keepalive / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				client.ping()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for {
+		msg, err := client.receive()
+		if err != nil {
+			return err
+		}
+		b.handle(msg)
+	}
+}
+
+// sets the variables the topic of the message is mapped to
+func (b *MQTTBridge) handle(msg *mqttMessage) {
+	vm := GetManager()
+	value := decodePayload(msg.payload)
+	for _, m := range b.config.Subscribe {
+		captures, ok := matchTopic(m.Topic, msg.topic)
+		if !ok {
+			continue
+		}
+
+		name := expand(m.Variable, captures)
+		if isInternal(name) {
+			log.Printf("mqtt: ignoring message on '%s', '%s' can not be set\n", msg.topic, name)
+			continue
+		}
+
+		if err := vm.setFrom(mqttOrigin, name, value); err != nil {
+			log.Printf("mqtt: unable to set '%s': %s\n", name, err.Error())
+		}
+	}
+}
+
+// publishes the changes of variables to the topics they are mapped to.
+// The subscription only keeps the latest change of every variable, so if
+// changes come in faster than they can be published, the broker still
+// gets the current values.
+func (b *MQTTBridge) publish(changes *Subscription) {
+	for range changes.Ready {
+		b.lock.Lock()
+		client := b.client
+		b.lock.Unlock()
+
+		values, _ := changes.Take()
+		for _, v := range values {
+			// changes caused by the broker itself are not sent back
+			if v.origin != mqttOrigin {
+				b.send(client, v)
+			}
+		}
+	}
+}
+
+// publishes a change to all topics the variable is mapped to
+func (b *MQTTBridge) send(client *mqttClient, v *Value) {
+	for _, m := range b.config.Publish {
+		captures, ok := matchVariable(m.Variable, v.Name)
+		if !ok {
+			continue
+		}
+
+		if client == nil {
+			log.Printf("mqtt: not connected, dropping change of '%s'\n", v.Name)
+			return
+		}
+
+		payload, err := encodePayload(v.Value)
+		if err != nil {
+			log.Printf("mqtt: unable to encode '%s': %s\n", v.Name, err.Error())
+			return
+		}
+
+		msg := &mqttMessage{
+			topic:   expand(m.Topic, captures),
+			payload: payload,
+			retain:  m.Retain,
+		}
+		if err := client.publish(msg); err != nil {
+			log.Printf("mqtt: unable to publish '%s': %s\n", v.Name, err.Error())
+		}
+	}
+}
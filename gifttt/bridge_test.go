@@ -0,0 +1,222 @@
+package gifttt
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern, topic string
+		captures       []string
+		ok             bool
+	}{
+		{"a/b", "a/b", []string{}, true},
+		{"a/b", "a/c", nil, false},
+		{"a/b", "a/b/c", nil, false},
+		{"a/b/c", "a/b", nil, false},
+		{"a/+/c", "a/x/c", []string{"x"}, true},
+		{"+/+", "a/b", []string{"a", "b"}, true},
+		{"+", "a/b", nil, false},
+		{"a/#", "a/b/c", []string{"b/c"}, true},
+		{"a/#", "a/b", []string{"b"}, true},
+		{"#", "a/b", []string{"a/b"}, true},
+		{"+/b/#", "a/b/c/d", []string{"a", "c/d"}, true},
+		{"+/b/#", "a/c/d", nil, false},
+	}
+	for _, test := range tests {
+		captures, ok := matchTopic(test.pattern, test.topic)
+		if ok != test.ok || (ok && !reflect.DeepEqual(captures, test.captures)) {
+			t.Errorf("matchTopic(%q, %q) = %q, %v, expected %q, %v", test.pattern, test.topic, captures, ok, test.captures, test.ok)
+		}
+	}
+}
+
+func TestMatchVariable(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		captures      []string
+		ok            bool
+	}{
+		{"light", "light", []string{}, true},
+		{"light", "lights", nil, false},
+		{"light:*", "light:kitchen", []string{"kitchen"}, true},
+		{"light:*", "light:", []string{""}, true},
+		{"light:*", "lamp:kitchen", nil, false},
+		{"*:*:temp", "sensor:kitchen:temp", []string{"sensor", "kitchen"}, true},
+		{"*:temp", "sensor:kitchen:temp", []string{"sensor:kitchen"}, true},
+		{"*:temp", "sensor:kitchen:humidity", nil, false},
+		{"*", "", []string{""}, true},
+	}
+	for _, test := range tests {
+		captures, ok := matchVariable(test.pattern, test.name)
+		if ok != test.ok || (ok && !reflect.DeepEqual(captures, test.captures)) {
+			t.Errorf("matchVariable(%q, %q) = %q, %v, expected %q, %v", test.pattern, test.name, captures, ok, test.captures, test.ok)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		template string
+		captures []string
+		result   string
+	}{
+		{"light", []string{}, "light"},
+		{"sensor:$1:temp", []string{"kitchen"}, "sensor:kitchen:temp"},
+		{"$2/$1", []string{"a", "b"}, "b/a"},
+		{"$1$1", []string{"a"}, "aa"},
+		{"$3", []string{"a"}, "$3"},
+		{"$10-$1", []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}, "j-a"},
+	}
+	for _, test := range tests {
+		if result := expand(test.template, test.captures); result != test.result {
+			t.Errorf("expand(%q, %q) = %q, expected %q", test.template, test.captures, result, test.result)
+		}
+	}
+}
+
+// a broker on the other end of a pipe, the packets sent by the client are
+// passed on to packets
+type fakeBroker struct {
+	client  *mqttClient
+	packets chan []byte
+}
+
+func newFakeBroker(conn net.Conn) *fakeBroker {
+	b := &fakeBroker{
+		client:  newMQTTClient(conn),
+		packets: make(chan []byte, 16),
+	}
+	go func() {
+		defer close(b.packets)
+		for {
+			header, body, err := b.client.read()
+			if err != nil {
+				return
+			}
+			b.packets <- append([]byte{header}, body...)
+		}
+	}()
+	return b
+}
+
+// waits for the next packet of the given type
+func (b *fakeBroker) expect(t *testing.T, kind byte) []byte {
+	select {
+	case packet, ok := <-b.packets:
+		if !ok {
+			t.Fatal("connection closed")
+		}
+		if packet[0]>>4 != kind {
+			t.Fatalf("received packet of type %d, expected %d", packet[0]>>4, kind)
+		}
+		return packet[1:]
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no packet of type %d received", kind)
+	}
+	return nil
+}
+
+// makes sure that the client sends nothing for a while
+func (b *fakeBroker) silent(t *testing.T) {
+	select {
+	case packet := <-b.packets:
+		t.Fatalf("received unexpected packet of type %d", packet[0]>>4)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBridge(t *testing.T) {
+	defer testStore(t)()
+	vm := GetManager()
+
+	client, server := net.Pipe()
+	defer server.Close()
+
+	bridge := NewMQTTBridge(&MQTTConfig{
+		ClientId:  "test",
+		KeepAlive: 60,
+		Subscribe: []*TopicMapping{
+			{Topic: "sensors/+/temp", Variable: "sensor:$1:temp", QoS: 1},
+			{Topic: "lights/+", Variable: "light:$1"},
+		},
+		Publish: []*TopicMapping{
+			{Variable: "light:*", Topic: "lights/$1"},
+		},
+	})
+	bridge.dial = func(string) (net.Conn, error) {
+		return client, nil
+	}
+
+	changes := vm.SubscribeLatest()
+	defer vm.Unsubscribe(changes)
+	go bridge.publish(changes)
+
+	session := make(chan error, 1)
+	go func() {
+		session <- bridge.session()
+	}()
+
+	broker := newFakeBroker(server)
+	broker.expect(t, mqttConnect)
+	broker.client.write(mqttConnack<<4, []byte{0, 0})
+
+	body := broker.expect(t, mqttSubscribe)
+	topics := []string{}
+	for rest := body[2:]; len(rest) > 0; rest = rest[1:] {
+		var topic string
+		topic, rest, _ = readString(rest)
+		topics = append(topics, topic)
+	}
+	if !reflect.DeepEqual(topics, []string{"sensors/+/temp", "lights/+"}) {
+		t.Fatalf("subscribed to %q", topics)
+	}
+	broker.client.write(mqttSuback<<4, []byte{body[0], body[1], 1, 0})
+
+	// messages set variables, QoS 1 messages are acknowledged
+	broker.client.write(mqttPublish<<4|0x02, append(appendString(nil, "sensors/kitchen/temp"), 0, 7, '2', '1', '.', '5'))
+	if puback := broker.expect(t, mqttPuback); !reflect.DeepEqual(puback, []byte{0, 7}) {
+		t.Errorf("puback for message %v", puback)
+	}
+	waitFor(t, "sensor:kitchen:temp", 21.5)
+
+	// changes are published, except the ones made by the broker, even if
+	// the value has been converted by the type of the variable
+	if err := vm.SetType("light:hall", &Type{Type: TypeBool, Coerce: true}); err != nil {
+		t.Fatal(err)
+	}
+	broker.client.write(mqttPublish<<4, append(appendString(nil, "lights/hall"), "on"...))
+	waitFor(t, "light:hall", true)
+	broker.silent(t)
+
+	if err := vm.Set("light:hall", false); err != nil {
+		t.Fatal(err)
+	}
+	body = broker.expect(t, mqttPublish)
+	topic, payload, _ := readString(body)
+	if topic != "lights/hall" || string(payload) != "false" {
+		t.Errorf("published %q to %q", payload, topic)
+	}
+
+	// a message that does not change the variable is not remembered, so
+	// the next change made here is still published
+	broker.client.write(mqttPublish<<4, append(appendString(nil, "lights/hall"), "off"...))
+	broker.silent(t)
+	if err := vm.Set("light:hall", true); err != nil {
+		t.Fatal(err)
+	}
+	body = broker.expect(t, mqttPublish)
+	if topic, payload, _ := readString(body); topic != "lights/hall" || string(payload) != "true" {
+		t.Errorf("published %q to %q", payload, topic)
+	}
+
+	server.Close()
+	select {
+	case <-session:
+	case <-time.After(2 * time.Second):
+		t.Fatal("session did not end with the connection")
+	}
+}
@@ -0,0 +1,43 @@
+package gifttt
+
+import (
+	"time"
+)
+
+// a variable computed from the current time
+type timeVar struct {
+	name  string
+	value func(t time.Time) interface{}
+}
+
+// the variables the rule manager keeps up to date every second, they can
+// not be changed through the API
+var timeVars = []timeVar{
+	{"time:second", func(t time.Time) interface{} { return int64(t.Second()) }},
+	{"time:minute", func(t time.Time) interface{} { return int64(t.Minute()) }},
+	{"time:hour", func(t time.Time) interface{} { return int64(t.Hour()) }},
+	{"time:dayminute", func(t time.Time) interface{} { return int64(t.Hour()*60 + t.Minute()) }},
+	{"time:epoch", func(t time.Time) interface{} { return t.Unix() }},
+	{"date:day", func(t time.Time) interface{} { return int64(t.Day()) }},
+	{"date:month", func(t time.Time) interface{} { return int64(t.Month()) }},
+	{"date:year", func(t time.Time) interface{} { return int64(t.Year()) }},
+	{"date:wday", func(t time.Time) interface{} { return int64(t.Weekday()) }},
+	{"date:yday", func(t time.Time) interface{} { return int64(t.YearDay()) }},
+	{"date:week", func(t time.Time) interface{} {
+		_, week := t.ISOWeek()
+		return int64(week)
+	}},
+	{"date:weekend", func(t time.Time) interface{} {
+		return t.Weekday() == time.Saturday || t.Weekday() == time.Sunday
+	}},
+}
+
+// sets all time variables to the given time
+func (m *RuleManager) tick(now time.Time) {
+	vm := GetManager()
+	now = now.In(m.Location)
+	for _, v := range timeVars {
+		vm.Set(v.name, v.value(now))
+	}
+	m.tickSun(now)
+}
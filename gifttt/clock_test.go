@@ -0,0 +1,62 @@
+package gifttt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeVars(t *testing.T) {
+	defer testStore(t)()
+	m, cleanup := testRuleManager(t)
+	defer cleanup()
+
+	// the variables are computed in the location of the rule manager,
+	// where it already is friday, 2016-01-01 01:30:15
+	m.Location = time.FixedZone("UTC+2", 2*60*60)
+	now := time.Date(2015, 12, 31, 23, 30, 15, 0, time.UTC)
+	m.tick(now)
+
+	tests := []struct {
+		name  string
+		value interface{}
+	}{
+		{"time:second", int64(15)},
+		{"time:minute", int64(30)},
+		{"time:hour", int64(1)},
+		{"time:dayminute", int64(90)},
+		{"time:epoch", now.Unix()},
+		{"date:day", int64(1)},
+		{"date:month", int64(1)},
+		{"date:year", int64(2016)},
+		{"date:wday", int64(5)},
+		{"date:yday", int64(1)},
+		// the first days of 2016 are still in the last week of 2015
+		{"date:week", int64(53)},
+		{"date:weekend", false},
+	}
+	vm := GetManager()
+	for _, test := range tests {
+		if value, err := vm.Get(test.name); err != nil || value != test.value {
+			t.Errorf("%s = %#v (%v), expected %#v", test.name, value, err, test.value)
+		}
+	}
+
+	m.tick(now.Add(24 * time.Hour))
+	if value, _ := vm.Get("date:weekend"); value != true {
+		t.Errorf("date:weekend = %#v on a saturday", value)
+	}
+	if value, _ := vm.Get("date:week"); value != int64(53) {
+		t.Errorf("date:week = %#v on saturday", value)
+	}
+}
+
+func TestIsInternal(t *testing.T) {
+	for _, v := range timeVars {
+		if !isInternal(v.name) {
+			t.Errorf("%s can be set", v.name)
+		}
+	}
+	if isInternal("time:wakeup") {
+		t.Error("time:wakeup can not be set")
+	}
+}
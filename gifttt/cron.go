@@ -0,0 +1,171 @@
+package gifttt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a range of allowed values in a field of a cron expression, with the
+// names that can be used instead of numbers
+type cronField struct {
+	min, max int
+	names    []string
+}
+
+var (
+	cronMinute = cronField{0, 59, nil}
+	cronHour   = cronField{0, 23, nil}
+	cronDay    = cronField{1, 31, nil}
+	cronMonth  = cronField{1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}}
+	cronWeek   = cronField{0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}
+)
+
+// A Schedule is a parsed cron expression with the five fields minute,
+// hour, day of month, month and day of week, e.g. "0 7 * * 1-5".
+type Schedule struct {
+	expr                           string
+	minute, hour, day, month, week uint64
+	// whether the day of month or day of week field starts with "*", in
+	// which case it does not count as restricted (e.g. "*/2")
+	anyDay, anyWeek bool
+}
+
+func ParseSchedule(expr string) (*Schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression '%s' needs 5 fields", expr)
+	}
+
+	s := &Schedule{
+		expr:    expr,
+		anyDay:  strings.HasPrefix(fields[2], "*"),
+		anyWeek: strings.HasPrefix(fields[4], "*"),
+	}
+
+	var err error
+	if s.minute, err = cronMinute.parse(fields[0]); err != nil {
+		return nil, err
+	}
+	if s.hour, err = cronHour.parse(fields[1]); err != nil {
+		return nil, err
+	}
+	if s.day, err = cronDay.parse(fields[2]); err != nil {
+		return nil, err
+	}
+	if s.month, err = cronMonth.parse(fields[3]); err != nil {
+		return nil, err
+	}
+	if s.week, err = cronWeek.parse(fields[4]); err != nil {
+		return nil, err
+	}
+
+	// sunday can be given as 0 or 7
+	if s.week&(1<<7) != 0 {
+		s.week |= 1
+	}
+	return s, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	for i, name := range f.names {
+		if strings.ToLower(s) == name {
+			return i + f.min, nil
+		}
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil || i < f.min || i > f.max {
+		return 0, fmt.Errorf("invalid value '%s' in cron expression", s)
+	}
+	return i, nil
+}
+
+// parses a field, which is a list of values, ranges (a-b) or "*", that
+// can be followed by a step (e.g. "*/15" or "1-5/2")
+func (f cronField) parse(field string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step '%s' in cron expression", part[i+1:])
+			}
+			part = part[:i]
+		}
+
+		start, end := f.min, f.max
+		if part != "*" {
+			var err error
+			bounds := strings.SplitN(part, "-", 2)
+			if start, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = f.value(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				end = f.max
+			}
+			if end < start {
+				return 0, fmt.Errorf("invalid range '%s' in cron expression", part)
+			}
+		}
+
+		for i := start; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+func (s *Schedule) String() string {
+	return s.expr
+}
+
+// if both day of month and day of week are restricted, a day matches if
+// either of them does (as cron does it). A field starting with "*" is
+// not restricted, so "*/2 * 1" only matches mondays on odd days.
+func (s *Schedule) matchDay(t time.Time) bool {
+	day := s.day&(1<<uint(t.Day())) != 0
+	week := s.week&(1<<uint(t.Weekday())) != 0
+	if !s.anyDay && !s.anyWeek {
+		return day || week
+	}
+	return day && week
+}
+
+// Next returns the first time after t that matches the schedule, in the
+// location of t. Returns the zero time if there is none within the next
+// five years (e.g. for "0 0 30 2 *").
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc).Add(time.Minute)
+
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
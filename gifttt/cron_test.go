@@ -0,0 +1,108 @@
+package gifttt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		expr string
+		ok   bool
+	}{
+		{"* * * * *", true},
+		{"0 7 * * 1-5", true},
+		{"*/15 * * * *", true},
+		{"0 0 1,15 jan-jun sun", true},
+		{"0 0 * * 7", true},
+		{"0 7 */2 * 1", true},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"*/0 * * * *", false},
+		{"5-1 * * * *", false},
+		{"* * * foo *", false},
+	}
+	for _, test := range tests {
+		_, err := ParseSchedule(test.expr)
+		if (err == nil) != test.ok {
+			t.Errorf("ParseSchedule(%q) returned %v", test.expr, err)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	// 2015-06-01 is a monday
+	start := time.Date(2015, 6, 1, 12, 30, 45, 0, time.UTC)
+	tests := []struct {
+		expr string
+		next []time.Time
+	}{
+		{"* * * * *", []time.Time{
+			time.Date(2015, 6, 1, 12, 31, 0, 0, time.UTC),
+			time.Date(2015, 6, 1, 12, 32, 0, 0, time.UTC),
+		}},
+		{"*/15 * * * *", []time.Time{
+			time.Date(2015, 6, 1, 12, 45, 0, 0, time.UTC),
+			time.Date(2015, 6, 1, 13, 0, 0, 0, time.UTC),
+		}},
+		{"0 7 * * 1-5", []time.Time{
+			time.Date(2015, 6, 2, 7, 0, 0, 0, time.UTC),
+			time.Date(2015, 6, 3, 7, 0, 0, 0, time.UTC),
+		}},
+		{"0 9 * * sat,sun", []time.Time{
+			time.Date(2015, 6, 6, 9, 0, 0, 0, time.UTC),
+			time.Date(2015, 6, 7, 9, 0, 0, 0, time.UTC),
+			time.Date(2015, 6, 13, 9, 0, 0, 0, time.UTC),
+		}},
+		{"0 0 * * 7", []time.Time{
+			time.Date(2015, 6, 7, 0, 0, 0, 0, time.UTC),
+		}},
+		// day of month or day of week
+		{"0 0 13 * 5", []time.Time{
+			time.Date(2015, 6, 5, 0, 0, 0, 0, time.UTC),
+			time.Date(2015, 6, 12, 0, 0, 0, 0, time.UTC),
+			time.Date(2015, 6, 13, 0, 0, 0, 0, time.UTC),
+			time.Date(2015, 6, 19, 0, 0, 0, 0, time.UTC),
+		}},
+		// a field starting with * is not restricted, so these are the
+		// mondays on odd days
+		{"0 7 */2 * 1", []time.Time{
+			time.Date(2015, 6, 15, 7, 0, 0, 0, time.UTC),
+			time.Date(2015, 6, 29, 7, 0, 0, 0, time.UTC),
+			time.Date(2015, 7, 13, 7, 0, 0, 0, time.UTC),
+		}},
+		{"0 7 1 * */2", []time.Time{
+			time.Date(2015, 8, 1, 7, 0, 0, 0, time.UTC),
+			time.Date(2015, 9, 1, 7, 0, 0, 0, time.UTC),
+		}},
+		{"30 6 29 2 *", []time.Time{
+			time.Date(2016, 2, 29, 6, 30, 0, 0, time.UTC),
+			time.Date(2020, 2, 29, 6, 30, 0, 0, time.UTC),
+		}},
+		{"0 0 30 2 *", []time.Time{
+			time.Time{},
+		}},
+	}
+	for _, test := range tests {
+		s, err := ParseSchedule(test.expr)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q) returned %s", test.expr, err.Error())
+			continue
+		}
+
+		now := start
+		for _, expected := range test.next {
+			next := s.Next(now)
+			if !next.Equal(expected) {
+				t.Errorf("%q: next after %s is %s, expected %s", test.expr, now, next, expected)
+				break
+			}
+			now = next
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package gifttt
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/drtoful/gifttt/Godeps/_workspace/src/github.com/drtoful/twik"
+	"github.com/drtoful/gifttt/Godeps/_workspace/src/github.com/drtoful/twik/ast"
+)
+
+// functions that depend on the rule they are evaluated in
+func (s *GlobalScope) functions() map[string]interface{} {
+	return map[string]interface{}{
+		"changed":      s.changedFn,
+		"prev":         s.prevFn,
+		"rising":       s.risingFn,
+		"falling":      s.fallingFn,
+		"for-duration": s.forDurationFn,
+		"after":        s.afterFn,
+		"run":          s.runFn,
+		"http-get":     s.httpGetFn,
+		"http-post":    s.httpPostFn,
+	}
+}
+
+// the name of a variable can be given as symbol (which is not evaluated)
+// or as any expression evaluating to a string
+func variableName(fn string, scope twik.Scope, args []ast.Node) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf(`function "%s" takes one argument`, fn)
+	}
+
+	if symbol, ok := args[0].(*ast.Symbol); ok {
+		return symbol.Name, nil
+	}
+
+	value, err := scope.Eval(args[0])
+	if err != nil {
+		return "", err
+	}
+	if name, ok := value.(string); ok {
+		return name, nil
+	}
+	return "", fmt.Errorf(`function "%s" takes a variable name`, fn)
+}
+
+// "changed" returns whether the rule is evaluated because of a change of
+// the given variable
+func (s *GlobalScope) changedFn(scope twik.Scope, args []ast.Node) (interface{}, error) {
+	name, err := variableName("changed", scope, args)
+	if err != nil {
+		return nil, err
+	}
+	return s.trigger != nil && s.trigger.Name == name, nil
+}
+
+// "prev" returns the value the variable had before its last change
+func (s *GlobalScope) prevFn(scope twik.Scope, args []ast.Node) (interface{}, error) {
+	name, err := variableName("prev", scope, args)
+	if err != nil {
+		return nil, err
+	}
+
+	vm := GetManager()
+	return vm.Previous(name), nil
+}
+
+// evaluates the condition and returns its current value together with
+// the value it had the last time this expression was evaluated in the
+// rule (false if it has never been evaluated)
+func (s *GlobalScope) edge(fn string, scope twik.Scope, args []ast.Node) (bool, bool, error) {
+	if len(args) != 1 {
+		return false, false, fmt.Errorf(`function "%s" takes one argument`, fn)
+	}
+
+	value, err := scope.Eval(args[0])
+	if err != nil {
+		return false, false, err
+	}
+
+	current := value != false && value != nil
+	last := s.edges[args[0].Pos()]
+	s.edges[args[0].Pos()] = current
+	return current, last, nil
+}
+
+// "rising" returns true if the condition is true now, but was false the
+// last time the rule has been evaluated
+func (s *GlobalScope) risingFn(scope twik.Scope, args []ast.Node) (interface{}, error) {
+	current, last, err := s.edge("rising", scope, args)
+	if err != nil {
+		return nil, err
+	}
+	return current && !last, nil
+}
+
+// "falling" returns true if the condition is false now, but was true the
+// last time the rule has been evaluated
+func (s *GlobalScope) fallingFn(scope twik.Scope, args []ast.Node) (interface{}, error) {
+	current, last, err := s.edge("falling", scope, args)
+	if err != nil {
+		return nil, err
+	}
+	return !current && last, nil
+}
+
+// keeps track of a condition given to "for-duration" while it is true
+type hold struct {
+	since time.Time
+	fired bool
+	timer *time.Timer
+}
+
+// "for-duration" evaluates action once, after the condition has been
+// true for the given duration. The rule is evaluated again when this
+// time has passed, so no other change is needed to trigger the action.
+func (s *GlobalScope) forDurationFn(scope twik.Scope, args []ast.Node) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, errors.New(`function "for-duration" takes three arguments`)
+	}
+
+	value, err := scope.Eval(args[0])
+	if err != nil {
+		return nil, err
+	}
+	text, ok := value.(string)
+	if !ok {
+		return nil, errors.New(`function "for-duration" takes a duration (e.g. "5m") as first argument`)
+	}
+	d, err := time.ParseDuration(text)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err = scope.Eval(args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	pos := args[1].Pos()
+	h, ok := s.hold(pos, value != false && value != nil, d)
+	if !ok {
+		return nil, nil
+	}
+	if h.fired || time.Since(h.since) < d {
+		return nil, nil
+	}
+
+	h.fired = true
+	return scope.Eval(args[2])
+}
+
+// starts keeping track of the condition at pos while it is true, and
+// stops if it is false. Returns the hold and whether it has already been
+// there before. The holds are changed with the rule's plock held, so that
+// closing the rule can stop their timers.
+func (s *GlobalScope) hold(pos ast.Pos, active bool, d time.Duration) (*hold, bool) {
+	rule := s.rule
+	rule.plock.Lock()
+	defer rule.plock.Unlock()
+
+	h, ok := s.holds[pos]
+	if !active {
+		if ok {
+			h.timer.Stop()
+			delete(s.holds, pos)
+		}
+		return nil, false
+	}
+	if ok || rule.closed {
+		return h, ok
+	}
+
+	s.holds[pos] = &hold{
+		since: time.Now(),
+		timer: time.AfterFunc(d, func() {
+			if m := GetRuleManager(); m != nil && !rule.isClosed() {
+				m.execute(getSession(), rule, nil)
+			}
+		}),
+	}
+	return nil, false
+}
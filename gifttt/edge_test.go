@@ -0,0 +1,111 @@
+package gifttt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEdges(t *testing.T) {
+	defer testStore(t)()
+	vm := GetManager()
+
+	rule, err := NewRule("edge.rule", strings.NewReader(`
+		(set out:changed (changed x))
+		(set out:prev (prev "x"))
+		(set out:rising (rising (> x 5)))
+		(set out:falling (falling (> x 5)))
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		// the change the rule is evaluated for
+		name  string
+		value int64
+		// the variables set by the rule
+		changed bool
+		prev    interface{}
+		rising  bool
+		falling bool
+	}{
+		{"x", 1, true, nil, false, false},
+		{"x", 7, true, int64(1), true, false},
+		// other changes do not change the edges
+		{"y", 1, false, int64(1), false, false},
+		{"x", 9, true, int64(7), false, false},
+		{"x", 2, true, int64(9), false, true},
+		{"y", 2, false, int64(9), false, false},
+		{"x", 3, true, int64(2), false, false},
+		{"x", 6, true, int64(3), true, false},
+	}
+	for i, test := range tests {
+		if err := vm.Set(test.name, test.value); err != nil {
+			t.Fatal(err)
+		}
+		if err := rule.Run("test", &Value{Name: test.name, Value: test.value}); err != nil {
+			t.Fatalf("%d: %s", i, err.Error())
+		}
+
+		for name, expected := range map[string]interface{}{
+			"out:changed": test.changed,
+			"out:prev":    test.prev,
+			"out:rising":  test.rising,
+			"out:falling": test.falling,
+		} {
+			if value, err := vm.Get(name); err != nil || value != expected {
+				t.Errorf("%d (%s = %d): %s is %#v, expected %#v", i, test.name, test.value, name, value, expected)
+			}
+		}
+	}
+
+	// without a trigger (e.g. in a timer) no variable has changed
+	if err := rule.Run("test", nil); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := vm.Get("out:changed"); value != false {
+		t.Errorf("changed is %#v without a trigger", value)
+	}
+}
+
+// every call of an edge function keeps its own state
+func TestEdgesPerCall(t *testing.T) {
+	defer testStore(t)()
+	vm := GetManager()
+
+	rule, err := NewRule("edge.rule", strings.NewReader(`
+		(set a (rising x))
+		(if (changed y) (set b (rising x)) nil)
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		value bool
+		a     bool
+		b     interface{}
+	}{
+		{"x", true, true, nil},
+		// the second call has not seen x before
+		{"y", true, false, true},
+		{"x", false, false, true},
+		{"y", false, false, false},
+		{"x", true, true, false},
+		{"y", true, false, true},
+	}
+	for i, test := range tests {
+		if err := vm.Set(test.name, test.value); err != nil {
+			t.Fatal(err)
+		}
+		if err := rule.Run("test", &Value{Name: test.name, Value: test.value}); err != nil {
+			t.Fatalf("%d: %s", i, err.Error())
+		}
+		a, _ := vm.Get("a")
+		b, _ := vm.Get("b")
+		if a != test.a || b != test.b {
+			t.Errorf("%d (%s = %v): a is %v and b is %v, expected %v and %v", i, test.name, test.value, a, b, test.a, test.b)
+		}
+	}
+}
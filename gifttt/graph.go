@@ -0,0 +1,99 @@
+package gifttt
+
+import (
+	"sort"
+)
+
+// returns the rules that are triggered when the given rule changes one
+// of the variables it writes
+func dependents(rule *Rule, rules []*Rule) []*Rule {
+	result := []*Rule{}
+	for _, r := range rules {
+		for _, read := range r.triggers() {
+			var found bool
+			for _, write := range rule.Writes {
+				if read == write {
+					found = true
+					break
+				}
+			}
+
+			if found {
+				result = append(result, r)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// findCycles returns all groups of rules that trigger each other in a
+// cycle (including single rules that trigger themselves). These are the
+// strongly connected components of the graph where every rule points to
+// the rules that read the variables it writes (see Tarjan's algorithm).
+func findCycles(rules []*Rule) [][]*Rule {
+	sorted := make([]*Rule, len(rules))
+	copy(sorted, rules)
+	sort.Sort(byFile(sorted))
+
+	var (
+		index   = 0
+		indices = make(map[*Rule]int)
+		lowlink = make(map[*Rule]int)
+		onstack = make(map[*Rule]bool)
+		stack   = []*Rule{}
+		cycles  = [][]*Rule{}
+		connect func(r *Rule)
+	)
+
+	connect = func(r *Rule) {
+		indices[r] = index
+		lowlink[r] = index
+		index += 1
+		stack = append(stack, r)
+		onstack[r] = true
+
+		self := false
+		for _, d := range dependents(r, sorted) {
+			if d == r {
+				self = true
+			}
+
+			if _, ok := indices[d]; !ok {
+				connect(d)
+				if lowlink[d] < lowlink[r] {
+					lowlink[r] = lowlink[d]
+				}
+			} else if onstack[d] && indices[d] < lowlink[r] {
+				lowlink[r] = indices[d]
+			}
+		}
+
+		if lowlink[r] != indices[r] {
+			return
+		}
+
+		component := []*Rule{}
+		for {
+			n := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onstack[n] = false
+			component = append(component, n)
+			if n == r {
+				break
+			}
+		}
+
+		if len(component) > 1 || self {
+			sort.Sort(byFile(component))
+			cycles = append(cycles, component)
+		}
+	}
+
+	for _, r := range sorted {
+		if _, ok := indices[r]; !ok {
+			connect(r)
+		}
+	}
+	return cycles
+}
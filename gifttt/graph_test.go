@@ -0,0 +1,87 @@
+package gifttt
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFindCycles(t *testing.T) {
+	tests := []struct {
+		rules  []string
+		cycles [][]string
+	}{
+		{[]string{`(set y x)`, `(set z y)`}, [][]string{}},
+		{[]string{`(set x (+ x 1))`}, [][]string{{"0.rule"}}},
+		{[]string{`(set y x)`, `(set x y)`}, [][]string{{"0.rule", "1.rule"}}},
+		{[]string{`(set y x)`, `(set z y)`, `(set x z)`, `(set w x)`}, [][]string{{"0.rule", "1.rule", "2.rule"}}},
+		{[]string{`(set y x)`, `(set x y)`, `(set b a)`, `(set a b)`}, [][]string{{"0.rule", "1.rule"}, {"2.rule", "3.rule"}}},
+		{[]string{`(rule :on (z)) (set y x)`, `(set x y)`}, [][]string{}},
+	}
+	for _, test := range tests {
+		rules := []*Rule{}
+		for i, source := range test.rules {
+			rule, err := NewRule(fmt.Sprintf("%d.rule", i), strings.NewReader(source))
+			if err != nil {
+				t.Fatalf("%s: %s", source, err.Error())
+			}
+			rules = append(rules, rule)
+		}
+
+		cycles := [][]string{}
+		for _, cycle := range findCycles(rules) {
+			files := []string{}
+			for _, r := range cycle {
+				files = append(files, r.File)
+			}
+			cycles = append(cycles, files)
+		}
+		if !reflect.DeepEqual(cycles, test.cycles) {
+			t.Errorf("%q has cycles %q, expected %q", test.rules, cycles, test.cycles)
+		}
+	}
+}
+
+func TestCycleWarnings(t *testing.T) {
+	defer testStore(t)()
+	m, cleanup := testRuleManager(t)
+	defer cleanup()
+
+	output := &bytes.Buffer{}
+	log.SetOutput(output)
+	defer log.SetOutput(os.Stderr)
+
+	steps := []struct {
+		put, remove string
+		source      string
+		warnings    int
+	}{
+		{put: "a.rule", source: `(set y x)`},
+		{put: "b.rule", source: `(set x y)`, warnings: 1},
+		// an existing cycle is not reported again
+		{put: "c.rule", source: `(set z 1)`},
+		{put: "a.rule", source: `(set y (+ x 1))`},
+		// but a new one is
+		{put: "c.rule", source: `(set z (+ z 1))`, warnings: 1},
+		{remove: "b.rule"},
+		{put: "b.rule", source: `(set x y)`, warnings: 1},
+	}
+	for i, step := range steps {
+		output.Reset()
+		if step.put != "" {
+			if err := m.Put(step.put, []byte(step.source)); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := m.Delete(step.remove); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := strings.Count(output.String(), "warning:"); n != step.warnings {
+			t.Errorf("step %d logged %d warnings, expected %d:\n%s", i, n, step.warnings, output.String())
+		}
+	}
+}
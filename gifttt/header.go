@@ -0,0 +1,149 @@
+package gifttt
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/drtoful/gifttt/Godeps/_workspace/src/github.com/drtoful/twik/ast"
+)
+
+// returns the header of a rule if its first expression is of the form
+// (rule :directive value ...)
+func findHeader(node ast.Node) *ast.List {
+	root, ok := node.(*ast.Root)
+	if !ok || len(root.Nodes) == 0 {
+		return nil
+	}
+
+	list, ok := root.Nodes[0].(*ast.List)
+	if !ok || len(list.Nodes) == 0 {
+		return nil
+	}
+
+	if symbol, ok := list.Nodes[0].(*ast.Symbol); !ok || symbol.Name != "rule" {
+		return nil
+	}
+	return list
+}
+
+// errors in the header are reported in the same form as the parser does
+func headerError(fset *ast.FileSet, node ast.Node, format string, args ...interface{}) error {
+	return fmt.Errorf("%s %s", fset.PosInfo(node.Pos()), fmt.Sprintf(format, args...))
+}
+
+func headerString(fset *ast.FileSet, key *ast.Symbol, node ast.Node) (string, error) {
+	if s, ok := node.(*ast.String); ok {
+		return s.Value, nil
+	}
+	return "", headerError(fset, node, "directive %s takes a string", key.Name)
+}
+
+func headerBool(fset *ast.FileSet, key *ast.Symbol, node ast.Node) (bool, error) {
+	if s, ok := node.(*ast.Symbol); ok {
+		switch s.Name {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+	}
+	return false, headerError(fset, node, "directive %s takes true or false", key.Name)
+}
+
+func headerInt(fset *ast.FileSet, key *ast.Symbol, node ast.Node) (int64, error) {
+	if i, ok := node.(*ast.Int); ok {
+		return i.Value, nil
+	}
+	return 0, headerError(fset, node, "directive %s takes an integer", key.Name)
+}
+
+// a list of names, given either as strings or symbols, e.g. ("door:state")
+func headerNames(fset *ast.FileSet, key *ast.Symbol, node ast.Node) ([]string, error) {
+	nodes := []ast.Node{node}
+	if list, ok := node.(*ast.List); ok {
+		nodes = list.Nodes
+	}
+
+	names := []string{}
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *ast.String:
+			names = append(names, n.Value)
+		case *ast.Symbol:
+			names = append(names, n.Name)
+		default:
+			return nil, headerError(fset, n, "directive %s takes a list of names", key.Name)
+		}
+	}
+	return names, nil
+}
+
+func headerDuration(fset *ast.FileSet, key *ast.Symbol, node ast.Node) (time.Duration, error) {
+	s, err := headerString(fset, key, node)
+	if err != nil {
+		return 0, err
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, headerError(fset, node, "directive %s takes a duration (e.g. \"2s\")", key.Name)
+	}
+	return d, nil
+}
+
+func headerSchedule(fset *ast.FileSet, key *ast.Symbol, node ast.Node) (*Schedule, error) {
+	s, err := headerString(fset, key, node)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule, err := ParseSchedule(s)
+	if err != nil {
+		return nil, headerError(fset, node, "%s", err)
+	}
+	return schedule, nil
+}
+
+// applies the directives in the header to the rule
+func parseHeader(fset *ast.FileSet, rule *Rule, header *ast.List) error {
+	nodes := header.Nodes[1:]
+	for i := 0; i < len(nodes); i += 2 {
+		key, ok := nodes[i].(*ast.Symbol)
+		if !ok || !strings.HasPrefix(key.Name, ":") {
+			return headerError(fset, nodes[i], "expected directive (e.g. :debounce)")
+		}
+		if i+1 >= len(nodes) {
+			return headerError(fset, key, "missing value for directive %s", key.Name)
+		}
+		value := nodes[i+1]
+
+		var err error
+		switch key.Name {
+		case ":name":
+			rule.Name, err = headerString(fset, key, value)
+			if err == nil && rule.Name == "" {
+				err = headerError(fset, value, "directive %s can not be empty", key.Name)
+			}
+		case ":description":
+			rule.Description, err = headerString(fset, key, value)
+		case ":enabled":
+			rule.Enabled, err = headerBool(fset, key, value)
+		case ":priority":
+			rule.Priority, err = headerInt(fset, key, value)
+		case ":debounce":
+			rule.Debounce, err = headerDuration(fset, key, value)
+		case ":on":
+			rule.Triggers, err = headerNames(fset, key, value)
+		case ":schedule":
+			rule.Schedule, err = headerSchedule(fset, key, value)
+		default:
+			err = headerError(fset, key, "unknown directive %s", key.Name)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package gifttt
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeader(t *testing.T) {
+	tests := []struct {
+		source      string
+		name        string
+		description string
+		enabled     bool
+		priority    int64
+		debounce    time.Duration
+	}{
+		{`(set x 1)`, "test.rule", "", true, 0, 0},
+		{`(rule) (set x 1)`, "test.rule", "", true, 0, 0},
+		{`(rule :name "lights") (set x 1)`, "lights", "", true, 0, 0},
+		{`(rule :description "turns on the lights")`, "test.rule", "turns on the lights", true, 0, 0},
+		{`(rule :enabled false)`, "test.rule", "", false, 0, 0},
+		{`(rule :enabled true :priority 10)`, "test.rule", "", true, 10, 0},
+		{`(rule :priority -5 :debounce "2s")`, "test.rule", "", true, -5, 2 * time.Second},
+		// a rule without a header is not mistaken for one
+		{`(rules :name "x")`, "test.rule", "", true, 0, 0},
+	}
+	for _, test := range tests {
+		rule, err := NewRule("test.rule", strings.NewReader(test.source))
+		if err != nil {
+			t.Errorf("%s: %s", test.source, err.Error())
+			continue
+		}
+		if rule.Name != test.name || rule.Description != test.description || rule.Enabled != test.enabled || rule.Priority != test.priority || rule.Debounce != test.debounce {
+			t.Errorf("%s: name %q, description %q, enabled %v, priority %d, debounce %s", test.source, rule.Name, rule.Description, rule.Enabled, rule.Priority, rule.Debounce)
+		}
+	}
+}
+
+func TestHeaderErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		err    string
+	}{
+		{`(rule :name)`, "missing value for directive :name"},
+		{`(rule name "x")`, "expected directive"},
+		{`(rule :name "")`, "directive :name can not be empty"},
+		{`(rule :name lights)`, "directive :name takes a string"},
+		{`(rule :enabled "yes")`, "directive :enabled takes true or false"},
+		{`(rule :priority 1.5)`, "directive :priority takes an integer"},
+		{`(rule :debounce "soon")`, "directive :debounce takes a duration"},
+		{`(rule :debounce "-1s")`, "directive :debounce takes a duration"},
+		{`(rule :color "red")`, "unknown directive :color"},
+	}
+	for _, test := range tests {
+		_, err := NewRule("test.rule", strings.NewReader(test.source))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s returned %v, expected %q", test.source, err, test.err)
+		}
+	}
+}
+
+// the header is not evaluated as part of the rule
+func TestHeaderNotEvaluated(t *testing.T) {
+	defer testStore(t)()
+
+	if err := runRule(t, `(rule :name "test") (set x 1)`); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "x", int64(1))
+}
+
+func TestOnDirective(t *testing.T) {
+	defer testStore(t)()
+	m, cleanup := testRuleManager(t)
+	defer cleanup()
+
+	tests := []struct {
+		source   string
+		triggers []string
+	}{
+		{`(set y (+ x z))`, []string{"x", "z"}},
+		{`(rule :on (x)) (set y (+ x z))`, []string{"x"}},
+		{`(rule :on ("door:state" time:hour)) (set y x)`, []string{"door:state", "time:hour"}},
+		{`(rule :on x) (set y (+ x z))`, []string{"x"}},
+		{`(rule :on ()) (set y x)`, []string{}},
+		// scheduled rules are only triggered by changes if they say so
+		{`(rule :schedule "0 7 * * *") (set y x)`, []string{}},
+		{`(rule :schedule "0 7 * * *" :on (x)) (set y x)`, []string{"x"}},
+	}
+	for _, test := range tests {
+		rule, err := NewRule("test.rule", strings.NewReader(test.source))
+		if err != nil {
+			t.Errorf("%s: %s", test.source, err.Error())
+			continue
+		}
+		if triggers := rule.triggers(); strings.Join(triggers, ",") != strings.Join(test.triggers, ",") {
+			t.Errorf("%s is triggered by %q, expected %q", test.source, triggers, test.triggers)
+		}
+	}
+
+	if _, err := NewRule("test.rule", strings.NewReader(`(rule :on (1))`)); err == nil {
+		t.Error(":on accepted a number")
+	}
+
+	// only the triggers are indexed, not all variables the rule reads
+	if err := m.Put("door.rule", []byte(`(rule :on (door)) (set light (and door dark))`)); err != nil {
+		t.Fatal(err)
+	}
+	if rules := m.triggered("door"); len(rules) != 1 || rules[0].File != "door.rule" {
+		t.Errorf("door triggers %v", rules)
+	}
+	if rules := m.triggered("dark"); len(rules) != 0 {
+		t.Errorf("dark triggers %v", rules)
+	}
+}
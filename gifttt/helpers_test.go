@@ -0,0 +1,112 @@
+package gifttt
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// opens a new store in a temporary directory, and gives the variable
+// manager a new queue (with the default size and policy) whose changes
+// are taken and dropped, as long as no rule manager dispatches them (see
+// testDispatch). The returned function closes and removes the store again.
+func testStore(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "gifttt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := StoreInit(filepath.Join(dir, "test.db")); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	vm := GetManager()
+	vm.lock.Lock()
+	vm.cache = make(map[string]*Value)
+	vm.previous = make(map[string]*Value)
+	vm.types = make(map[string]*Type)
+	vm.lock.Unlock()
+	stop := consume(func(*Value) {})
+
+	return func() {
+		stop()
+		GetStore().Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// replaces the queue of the variable manager with a new one, and passes
+// all changes added to it to fn. The returned function stops taking
+// changes from the queue.
+func consume(fn func(v *Value)) func() {
+	events, _ := NewEventQueue(DefaultQueueSize, PolicyBlock)
+	vm := GetManager()
+	vm.lock.Lock()
+	vm.Events = events
+	vm.lock.Unlock()
+
+	last := &Value{}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for v := events.Pop(); v != last; v = events.Pop() {
+			fn(v)
+		}
+	}()
+	return func() {
+		events.Push(last)
+		<-done
+	}
+}
+
+// dispatches the changes of variables to the rules of the manager, as
+// its Run does
+func testDispatch(m *RuleManager) func() {
+	return consume(m.dispatch)
+}
+
+// starts a server with the handlers of the API, the returned server has
+// to be closed by the caller
+func testAPI() *httptest.Server {
+	return httptest.NewServer(NewAPIServer("", "").handler)
+}
+
+// creates a rule manager for an empty rule directory, the returned
+// function removes it again
+func testRuleManager(t *testing.T) (*RuleManager, func()) {
+	dir, err := ioutil.TempDir("", "gifttt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewRuleManager(dir), func() {
+		_rules = nil
+		os.RemoveAll(dir)
+	}
+}
+
+// evaluates the source as rule
+func runRule(t *testing.T, source string) error {
+	rule, err := NewRule("test.rule", strings.NewReader(source))
+	if err != nil {
+		t.Fatalf("%s: %s", source, err.Error())
+	}
+	return rule.Run("test", nil)
+}
+
+// waits up to a second for the variable to get the value
+func waitFor(t *testing.T, name string, value interface{}) {
+	vm := GetManager()
+	for i := 0; i < 100; i += 1 {
+		if v, _ := vm.Get(name); reflect.DeepEqual(v, value) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	v, _ := vm.Get(name)
+	t.Fatalf("%s = %#v, expected %#v", name, v, value)
+}
@@ -0,0 +1,295 @@
+package gifttt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+var (
+	retentionPrefix = "retention~"
+)
+
+// Retention defines which values of a variable are kept in its history.
+// Count limits the number of values and Age (in seconds) how old they
+// can get, 0 means no limit. The history is disabled if both are 0.
+type Retention struct {
+	Count int   `json:"count"`
+	Age   int64 `json:"age"`
+}
+
+func (r *Retention) enabled() bool {
+	return r.Count > 0 || r.Age > 0
+}
+
+// a value of a variable at a specific point in time
+type HistoryValue struct {
+	Time  time.Time   `json:"time"`
+	Value interface{} `json:"value"`
+}
+
+// sets the retention for all variables that don't have their own, except
+// for the internal ones
+func (vm *VariableManager) SetDefaultRetention(r Retention) {
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+	vm.retention = r
+}
+
+// returns the retention of a variable's history
+func (vm *VariableManager) Retention(name string) (*Retention, error) {
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+	return vm.getRetention(name)
+}
+
+// same as Retention, but has to be called with the lock held
+func (vm *VariableManager) getRetention(name string) (*Retention, error) {
+	store := GetStore()
+	b, err := store.Get(retentionPrefix + name)
+	if err == ErrNotFound {
+		// internal variables change all the time, so their history is
+		// only kept if asked for
+		if isInternal(name) {
+			return &Retention{}, nil
+		}
+		r := vm.retention
+		return &r, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	r := &Retention{}
+	if err := json.Unmarshal([]byte(b), r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// sets the retention of a variable's history, nil resets it to the default
+func (vm *VariableManager) SetRetention(name string, r *Retention) error {
+	store := GetStore()
+	if r == nil {
+		if err := store.Delete(retentionPrefix + name); err != nil && err != ErrNotFound {
+			return err
+		}
+		return nil
+	}
+
+	if r.Count < 0 || r.Age < 0 {
+		return errors.New("retention can not be negative")
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return store.Set(retentionPrefix+name, string(b))
+}
+
+// writes the value of a variable and adds it to its history if enabled,
+// both in the same transaction. Has to be called with the lock held.
+func (vm *VariableManager) write(v *Value, t time.Time) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	r, err := vm.getRetention(v.Name)
+	if err != nil {
+		return err
+	}
+
+	store := GetStore()
+	if !r.enabled() {
+		return store.Set(varPrefix+v.Name, string(b))
+	}
+
+	h, err := json.Marshal(v.Value)
+	if err != nil {
+		return err
+	}
+	return store.SetAndAppendHistory(varPrefix+v.Name, string(b), v.Name, t, string(h), r.Count, time.Duration(r.Age)*time.Second)
+}
+
+// returns all values a variable had between from and to (inclusive),
+// ordered from oldest to newest
+func (vm *VariableManager) History(name string, from, to time.Time) ([]*HistoryValue, error) {
+	store := GetStore()
+	entries, err := store.History(name, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]*HistoryValue, len(entries))
+	for i, e := range entries {
+		var value interface{}
+		if err := json.Unmarshal([]byte(e.Value), &value); err != nil {
+			return nil, err
+		}
+		values[i] = &HistoryValue{Time: e.Time, Value: value}
+	}
+	return values, nil
+}
+
+// "history" returns the values a variable had in the last seconds
+func historyFn(args []interface{}) (interface{}, error) {
+	if len(args) == 2 {
+		name, ok1 := args[0].(string)
+		seconds, ok2 := args[1].(int64)
+		if ok1 && ok2 {
+			now := time.Now()
+			vm := GetManager()
+			values, err := vm.History(name, now.Add(-time.Duration(seconds)*time.Second), now)
+			if err != nil {
+				return nil, err
+			}
+
+			result := make([]interface{}, len(values))
+			for i, v := range values {
+				result[i] = v.Value
+			}
+			return result, nil
+		}
+	}
+	return nil, errors.New("history function takes a string and integer argument")
+}
+
+// returns the values a variable had in the last seconds. As values are
+// only recorded when they change, the value the variable had at the start
+// of this window is included as well (with the start as its time).
+func window(name string, seconds int64) ([]*HistoryValue, error) {
+	now := time.Now()
+	from := now.Add(-time.Duration(seconds) * time.Second)
+
+	vm := GetManager()
+	values, err := vm.History(name, from, now)
+	if err != nil {
+		return nil, err
+	}
+
+	store := GetStore()
+	entry, err := store.Before(name, from)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		var value interface{}
+		if err := json.Unmarshal([]byte(entry.Value), &value); err != nil {
+			return nil, err
+		}
+		values = append([]*HistoryValue{{Time: from, Value: value}}, values...)
+	}
+
+	return values, nil
+}
+
+// same as window, but checks that all values are numeric and converts
+// them to float64
+func numericWindow(fn string, args []interface{}) ([]float64, []time.Time, error) {
+	if len(args) != 2 {
+		return nil, nil, fmt.Errorf(`function "%s" takes a string and integer argument`, fn)
+	}
+	name, ok1 := args[0].(string)
+	seconds, ok2 := args[1].(int64)
+	if !ok1 || !ok2 {
+		return nil, nil, fmt.Errorf(`function "%s" takes a string and integer argument`, fn)
+	}
+
+	values, err := window(name, seconds)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nums := make([]float64, len(values))
+	times := make([]time.Time, len(values))
+	for i, v := range values {
+		// values are stored as JSON, so all numbers are float64
+		value, ok := v.Value.(float64)
+		if !ok {
+			return nil, nil, fmt.Errorf(`function "%s" can not use value %#v`, fn, v.Value)
+		}
+		nums[i] = value
+		times[i] = v.Time
+	}
+	return nums, times, nil
+}
+
+// "avg" returns the time-weighted average of a variable over the last
+// seconds, so that a value counts as long as the variable had it
+func avgFn(args []interface{}) (interface{}, error) {
+	nums, times, err := numericWindow("avg", args)
+	if err != nil || len(nums) == 0 {
+		return nil, err
+	}
+
+	now := time.Now()
+	var sum, total float64
+	for i := range nums {
+		end := now
+		if i+1 < len(times) {
+			end = times[i+1]
+		}
+		d := end.Sub(times[i]).Seconds()
+		sum += nums[i] * d
+		total += d
+	}
+
+	if total == 0 {
+		return nums[len(nums)-1], nil
+	}
+	return sum / total, nil
+}
+
+// "min" returns the smallest value of a variable in the last seconds
+func minFn(args []interface{}) (interface{}, error) {
+	nums, _, err := numericWindow("min", args)
+	if err != nil || len(nums) == 0 {
+		return nil, err
+	}
+
+	result := math.Inf(1)
+	for _, n := range nums {
+		result = math.Min(result, n)
+	}
+	return result, nil
+}
+
+// "max" returns the largest value of a variable in the last seconds
+func maxFn(args []interface{}) (interface{}, error) {
+	nums, _, err := numericWindow("max", args)
+	if err != nil || len(nums) == 0 {
+		return nil, err
+	}
+
+	result := math.Inf(-1)
+	for _, n := range nums {
+		result = math.Max(result, n)
+	}
+	return result, nil
+}
+
+// "delta" returns by how much a variable changed in the last seconds
+func deltaFn(args []interface{}) (interface{}, error) {
+	nums, _, err := numericWindow("delta", args)
+	if err != nil || len(nums) == 0 {
+		return nil, err
+	}
+	return nums[len(nums)-1] - nums[0], nil
+}
+
+// "rate" returns the average change of a variable per second over the
+// last seconds, or since its first value if that is more recent
+func rateFn(args []interface{}) (interface{}, error) {
+	nums, times, err := numericWindow("rate", args)
+	if err != nil || len(nums) == 0 {
+		return nil, err
+	}
+
+	d := time.Now().Sub(times[0]).Seconds()
+	if d <= 0 {
+		return float64(0), nil
+	}
+	return (nums[len(nums)-1] - nums[0]) / d, nil
+}
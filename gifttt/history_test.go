@@ -0,0 +1,186 @@
+package gifttt
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAggregates(t *testing.T) {
+	defer testStore(t)()
+
+	// temp was 10 before the window, changed to 20 50s and to 30 10s ago
+	now := time.Now()
+	store := GetStore()
+	for _, v := range []struct {
+		ago   time.Duration
+		value string
+	}{
+		{100 * time.Second, "10"},
+		{50 * time.Second, "20"},
+		{10 * time.Second, "30"},
+	} {
+		if err := store.AppendHistory("temp", now.Add(-v.ago), v.value, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.AppendHistory("state", now.Add(-time.Second), `"on"`, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		fn     func([]interface{}) (interface{}, error)
+		args   []interface{}
+		result interface{}
+	}{
+		// 10 for 10s, 20 for 40s and 30 for 10s
+		{"avg", avgFn, []interface{}{"temp", int64(60)}, 20.0},
+		{"avg", avgFn, []interface{}{"temp", int64(5)}, 30.0},
+		{"min", minFn, []interface{}{"temp", int64(60)}, 10.0},
+		{"min", minFn, []interface{}{"temp", int64(30)}, 20.0},
+		{"max", maxFn, []interface{}{"temp", int64(60)}, 30.0},
+		{"max", maxFn, []interface{}{"temp", int64(200)}, 30.0},
+		{"delta", deltaFn, []interface{}{"temp", int64(60)}, 20.0},
+		{"delta", deltaFn, []interface{}{"temp", int64(5)}, 0.0},
+		{"rate", rateFn, []interface{}{"temp", int64(60)}, 20.0 / 60},
+		// temp only has values for the last 100s
+		{"rate", rateFn, []interface{}{"temp", int64(200)}, 20.0 / 100},
+		// variables without history have no value
+		{"avg", avgFn, []interface{}{"other", int64(60)}, nil},
+		{"rate", rateFn, []interface{}{"other", int64(60)}, nil},
+	}
+	for _, test := range tests {
+		result, err := test.fn(test.args)
+		if err != nil {
+			t.Errorf("%s%v returned %s", test.name, test.args, err.Error())
+			continue
+		}
+
+		expected, ok := test.result.(float64)
+		if !ok {
+			if result != test.result {
+				t.Errorf("%s%v = %v, expected %v", test.name, test.args, result, test.result)
+			}
+			continue
+		}
+		if f, ok := result.(float64); !ok || math.Abs(f-expected) > 0.01 {
+			t.Errorf("%s%v = %v, expected %v", test.name, test.args, result, expected)
+		}
+	}
+
+	invalid := [][]interface{}{
+		{"state", int64(60)},
+		{"temp"},
+		{"temp", "60"},
+		{int64(1), int64(60)},
+	}
+	for _, args := range invalid {
+		if _, err := avgFn(args); err == nil {
+			t.Errorf("avg%v did not return an error", args)
+		}
+	}
+}
+
+func TestHistoryRetention(t *testing.T) {
+	defer testStore(t)()
+	vm := GetManager()
+
+	if err := vm.SetRetention("count", &Retention{Count: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.SetRetention("none", &Retention{}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i += 1 {
+		for _, name := range []string{"count", "none"} {
+			if err := vm.Set(name, int64(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	values, err := vm.History("count", time.Time{}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values[0].Value != 2.0 || values[1].Value != 3.0 {
+		t.Errorf("history of count is %v", values)
+	}
+
+	if values, err = vm.History("none", time.Time{}, time.Now()); err != nil || len(values) != 0 {
+		t.Errorf("history of none is %v (%v)", values, err)
+	}
+	if err := vm.SetRetention("none", &Retention{Count: -1}); err == nil {
+		t.Error("negative retention has been accepted")
+	}
+
+	// internal variables only have a history if asked for
+	vm.SetDefaultRetention(Retention{Count: 10})
+	defer vm.SetDefaultRetention(Retention{})
+	if r, err := vm.Retention("time:second"); err != nil || r.enabled() {
+		t.Errorf("retention of time:second is %v (%v)", r, err)
+	}
+	if err := vm.SetRetention("time:second", &Retention{Count: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := vm.Retention("time:second"); err != nil || r.Count != 10 {
+		t.Errorf("retention of time:second is %v (%v)", r, err)
+	}
+}
+
+func TestHistoryTrim(t *testing.T) {
+	defer testStore(t)()
+	store := GetStore()
+
+	tests := []struct {
+		count int
+		age   time.Duration
+		// seconds after the first entry the remaining ones were added
+		kept []int
+	}{
+		{0, 0, []int{0, 1, 2, 3, 4, 5}},
+		{3, 0, []int{3, 4, 5}},
+		{0, 2 * time.Second, []int{3, 4, 5}},
+		{4, 3 * time.Second, []int{2, 3, 4, 5}},
+		{2, 10 * time.Second, []int{4, 5}},
+		{1, 0, []int{5}},
+	}
+	start := time.Unix(1000, 0)
+	for _, test := range tests {
+		if err := store.DeleteHistory("x"); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 6; i += 1 {
+			if err := store.AppendHistory("x", start.Add(time.Duration(i)*time.Second), "1", test.count, test.age); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		entries, err := store.History("x", start, start.Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept := []int{}
+		for _, e := range entries {
+			kept = append(kept, int(e.Time.Sub(start).Seconds()))
+		}
+		if !reflect.DeepEqual(kept, test.kept) {
+			t.Errorf("count %d and age %s kept %v, expected %v", test.count, test.age, kept, test.kept)
+		}
+	}
+
+	// adding the same entry again does not count twice
+	for i := 0; i < 2; i += 1 {
+		if err := store.AppendHistory("x", start.Add(5*time.Second), "2", 1, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.AppendHistory("x", start.Add(6*time.Second), "3", 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := store.History("x", start, start.Add(time.Minute)); err != nil || len(entries) != 2 {
+		t.Errorf("history is %v (%v)", entries, err)
+	}
+}
@@ -0,0 +1,189 @@
+package gifttt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/drtoful/gifttt/Godeps/_workspace/src/github.com/drtoful/twik"
+	"github.com/drtoful/gifttt/Godeps/_workspace/src/github.com/drtoful/twik/ast"
+)
+
+var (
+	// the client used by "http-get" and "http-post", the timeout is set
+	// for every request
+	HTTPClient = &http.Client{}
+
+	// how long a single request can take, unless the rule gives another
+	// timeout
+	DefaultHTTPTimeout = 10 * time.Second
+
+	// the time to wait before the first retry, it is doubled for every
+	// further retry
+	HTTPBackoff = 500 * time.Millisecond
+
+	// responses are cut off after this many bytes
+	maxResponseSize int64 = 1 << 20
+)
+
+// "http-get" requests the url and returns the status and the body of
+// the response as list
+func (s *GlobalScope) httpGetFn(scope twik.Scope, args []ast.Node) (interface{}, error) {
+	values, options, err := evalArgs("http-get", scope, args, ":headers", ":timeout")
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != 1 {
+		return nil, errors.New(`function "http-get" takes an url`)
+	}
+	return s.request("http-get", "GET", values[0], nil, options)
+}
+
+// "http-post" sends the body to the url and returns the status and the
+// body of the response as list. Bodies that are not strings are sent as
+// JSON. If retries are given, failed requests are sent again in the
+// background, after the rule has been evaluated.
+func (s *GlobalScope) httpPostFn(scope twik.Scope, args []ast.Node) (interface{}, error) {
+	values, options, err := evalArgs("http-post", scope, args, ":headers", ":timeout", ":retries")
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != 2 {
+		return nil, errors.New(`function "http-post" takes an url and a body`)
+	}
+	return s.request("http-post", "POST", values[0], values[1], options)
+}
+
+func (s *GlobalScope) request(fn, method string, url, body interface{}, options map[string]interface{}) (interface{}, error) {
+	target, ok := url.(string)
+	if !ok {
+		return nil, fmt.Errorf(`function "%s" takes an url as string`, fn)
+	}
+
+	// invalid urls are not worth a retry
+	if _, err := http.NewRequest(method, target, nil); err != nil {
+		return nil, err
+	}
+
+	timeout, err := durationOption(fn, options, ":timeout", DefaultHTTPTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	retries := 0
+	if value, ok := options[":retries"]; ok {
+		n, ok := value.(int64)
+		if !ok || n < 0 {
+			return nil, fmt.Errorf(`option :retries of function "%s" takes a number`, fn)
+		}
+		retries = int(n)
+	}
+
+	headers := http.Header{}
+	if value, ok := options[":headers"]; ok {
+		list, ok := value.([]interface{})
+		if !ok || len(list)%2 != 0 {
+			return nil, fmt.Errorf(`option :headers of function "%s" takes a list of names and values`, fn)
+		}
+		for i := 0; i < len(list); i += 2 {
+			name, ok1 := list[i].(string)
+			value, ok2 := list[i+1].(string)
+			if !ok1 || !ok2 {
+				return nil, fmt.Errorf(`option :headers of function "%s" takes a list of names and values`, fn)
+			}
+			headers.Add(name, value)
+		}
+	}
+
+	var data []byte
+	switch body := body.(type) {
+	case nil:
+	case string:
+		data = []byte(body)
+		if headers.Get("Content-Type") == "" {
+			headers.Set("Content-Type", "text/plain; charset=utf-8")
+		}
+	default:
+		if data, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+		if headers.Get("Content-Type") == "" {
+			headers.Set("Content-Type", "application/json")
+		}
+	}
+
+	client := *HTTPClient
+	client.Timeout = timeout
+
+	log.Printf("[%s] %s %s\n", s.session, method, target)
+	status, response, err := send(&client, method, target, headers, data)
+	if failed(status, err) && retries > 0 {
+		go retry(s.session, &client, method, target, headers, data, retries)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{int64(status), response}, nil
+}
+
+// only errors of the server are worth another try
+func failed(status int, err error) bool {
+	return err != nil || status >= 500 || status == http.StatusTooManyRequests
+}
+
+// sends a failed request again until it succeeds or the retries are used
+// up, waiting longer before every retry. This happens outside of the rule,
+// so that it is not held up in the meantime.
+func retry(session string, client *http.Client, method, url string, headers http.Header, data []byte, retries int) {
+	backoff := HTTPBackoff
+	for attempt := 1; attempt <= retries; attempt += 1 {
+		log.Printf("[%s] %s %s failed, retrying in %s\n", session, method, url, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+
+		status, _, err := send(client, method, url, headers, data)
+		if !failed(status, err) {
+			log.Printf("[%s] %s %s succeeded with status %d\n", session, method, url, status)
+			return
+		}
+		if err != nil {
+			log.Printf("[%s] %s %s failed: %s\n", session, method, url, err.Error())
+		} else {
+			log.Printf("[%s] %s %s failed with status %d\n", session, method, url, status)
+		}
+	}
+	log.Printf("[%s] %s %s failed %d times, giving up\n", session, method, url, retries+1)
+}
+
+func send(client *http.Client, method, url string, headers http.Header, data []byte) (int, string, error) {
+	var body io.Reader
+	if data != nil {
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return 0, "", err
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	response, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return 0, "", err
+	}
+	return resp.StatusCode, string(response), nil
+}
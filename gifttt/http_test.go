@@ -0,0 +1,200 @@
+package gifttt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a server that answers with the given statuses in turn and remembers
+// the requests it got
+type testServer struct {
+	*httptest.Server
+	lock     *sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+}
+
+func newTestServer(statuses ...int) *testServer {
+	s := &testServer{
+		lock:     &sync.Mutex{},
+		statuses: statuses,
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		s.lock.Lock()
+		status := http.StatusOK
+		if n := len(s.requests); n < len(s.statuses) {
+			status = s.statuses[n]
+		}
+		s.requests = append(s.requests, r)
+		s.bodies = append(s.bodies, string(body))
+		s.lock.Unlock()
+
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	}))
+	return s
+}
+
+// waits until the server got n requests, returns the number it got
+func (s *testServer) wait(n int) int {
+	for i := 0; i < 100; i += 1 {
+		s.lock.Lock()
+		count := len(s.requests)
+		s.lock.Unlock()
+		if count >= n {
+			return count
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.requests)
+}
+
+func TestHTTPGet(t *testing.T) {
+	defer testStore(t)()
+	server := newTestServer()
+	defer server.Close()
+
+	source := fmt.Sprintf(`(set result (http-get "%s/status" :headers (list "X-Token" "1234") :timeout "1s"))`, server.URL)
+	if err := runRule(t, source); err != nil {
+		t.Fatal(err)
+	}
+
+	result, _ := GetManager().Get("result")
+	if !reflect.DeepEqual(result, []interface{}{int64(200), "GET /status"}) {
+		t.Errorf("http-get returned %#v", result)
+	}
+	if token := server.requests[0].Header.Get("X-Token"); token != "1234" {
+		t.Errorf("header X-Token is %q", token)
+	}
+}
+
+func TestHTTPPost(t *testing.T) {
+	defer testStore(t)()
+	server := newTestServer()
+	defer server.Close()
+
+	tests := []struct {
+		body        string
+		sent        string
+		contentType string
+	}{
+		{`"on"`, "on", "text/plain; charset=utf-8"},
+		{`(object "state" "on" "level" 2)`, `{"level":2,"state":"on"}`, "application/json"},
+		{`(list 1 "a")`, `[1,"a"]`, "application/json"},
+	}
+	for i, test := range tests {
+		source := fmt.Sprintf(`(set result (http-post "%s/hook" %s))`, server.URL, test.body)
+		if err := runRule(t, source); err != nil {
+			t.Fatal(err)
+		}
+
+		result, _ := GetManager().Get("result")
+		if !reflect.DeepEqual(result, []interface{}{int64(200), "POST /hook"}) {
+			t.Errorf("http-post returned %#v", result)
+		}
+		if server.bodies[i] != test.sent {
+			t.Errorf("http-post with %s sent %q, expected %q", test.body, server.bodies[i], test.sent)
+		}
+		if ct := server.requests[i].Header.Get("Content-Type"); ct != test.contentType {
+			t.Errorf("http-post with %s sent content type %q, expected %q", test.body, ct, test.contentType)
+		}
+	}
+}
+
+func TestHTTPPostRetries(t *testing.T) {
+	defer testStore(t)()
+	defer func(backoff time.Duration) { HTTPBackoff = backoff }(HTTPBackoff)
+	HTTPBackoff = time.Millisecond
+
+	// posts are not retried by default
+	server := newTestServer(503, 503)
+	source := fmt.Sprintf(`(set result (http-post "%s/hook" "on"))`, server.URL)
+	if err := runRule(t, source); err != nil {
+		t.Fatal(err)
+	}
+	result, _ := GetManager().Get("result")
+	if !reflect.DeepEqual(result, []interface{}{int64(503), "POST /hook"}) {
+		t.Errorf("http-post returned %#v", result)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := server.wait(1); n != 1 {
+		t.Errorf("http-post without retries sent %d requests", n)
+	}
+	server.Close()
+
+	// the rule gets the first response, the retries happen afterwards
+	server = newTestServer(503, 429, 200)
+	source = fmt.Sprintf(`(set result (http-post "%s/hook" "on" :retries 5))`, server.URL)
+	if err := runRule(t, source); err != nil {
+		t.Fatal(err)
+	}
+	result, _ = GetManager().Get("result")
+	if !reflect.DeepEqual(result, []interface{}{int64(503), "POST /hook"}) {
+		t.Errorf("http-post returned %#v", result)
+	}
+	if n := server.wait(3); n != 3 {
+		t.Errorf("http-post with retries sent %d requests, expected 3", n)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := server.wait(4); n != 3 {
+		t.Errorf("http-post has been retried after it succeeded, sent %d requests", n)
+	}
+	server.Close()
+
+	// client errors are not retried
+	server = newTestServer(400)
+	source = fmt.Sprintf(`(http-post "%s/hook" "on" :retries 5)`, server.URL)
+	if err := runRule(t, source); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := server.wait(1); n != 1 {
+		t.Errorf("http-post with status 400 sent %d requests", n)
+	}
+	server.Close()
+}
+
+func TestHTTPErrors(t *testing.T) {
+	defer testStore(t)()
+	server := newTestServer()
+	defer server.Close()
+
+	tests := []string{
+		`(http-get)`,
+		`(http-get 1)`,
+		`(http-get "%s" :retries 1)`,
+		`(http-get "%s" :timeout "1")`,
+		`(http-get "%s" :timeout)`,
+		`(http-get "%s" :headers (list "X-Token"))`,
+		`(http-get "%s" :headers (list "X-Token" 1))`,
+		`(http-get "://invalid")`,
+		`(http-post "%s")`,
+		`(http-post "%s" "on" :retries "1")`,
+		`(http-post "%s" "on" :retries -1)`,
+		`(http-post "%s" (object "x" (func (a) a)))`,
+	}
+	for _, test := range tests {
+		source := test
+		if strings.Contains(test, "%s") {
+			source = fmt.Sprintf(test, server.URL)
+		}
+		if err := runRule(t, source); err == nil {
+			t.Errorf("%s did not fail", test)
+		}
+	}
+	if len(server.requests) != 0 {
+		t.Errorf("%d requests have been sent", len(server.requests))
+	}
+}
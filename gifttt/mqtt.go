@@ -0,0 +1,257 @@
+package gifttt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the types of MQTT 3.1.1 control packets used by the client
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+	mqttMaxPacket   = 1 << 20
+	mqttDialTimeout = 10 * time.Second
+)
+
+var (
+	ErrMQTTPacket = errors.New("malformed mqtt packet")
+)
+
+// a message received from or sent to the broker
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+}
+
+// a minimal MQTT 3.1.1 client, that publishes with QoS 0 and receives
+// messages with QoS 0 and 1
+type mqttClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	wlock  *sync.Mutex
+	nextId uint16
+	// how long to wait for the next packet from the broker
+	timeout time.Duration
+}
+
+// connects to the broker, which is given as "tcp://host:port" or
+// "tls://host:port"
+func dialMQTT(broker string) (net.Conn, error) {
+	switch {
+	case strings.HasPrefix(broker, "tls://") || strings.HasPrefix(broker, "ssl://"):
+		dialer := &net.Dialer{Timeout: mqttDialTimeout}
+		return tls.DialWithDialer(dialer, "tcp", broker[6:], nil)
+	case strings.HasPrefix(broker, "tcp://"):
+		return net.DialTimeout("tcp", broker[6:], mqttDialTimeout)
+	}
+	return net.DialTimeout("tcp", broker, mqttDialTimeout)
+}
+
+func newMQTTClient(conn net.Conn) *mqttClient {
+	return &mqttClient{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		wlock:  &sync.Mutex{},
+	}
+}
+
+func appendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, ErrMQTTPacket
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, ErrMQTTPacket
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
+
+func (c *mqttClient) write(header byte, body []byte) error {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+func (c *mqttClient) read() (byte, []byte, error) {
+	if c.timeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+	header, err := c.reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	n, multiplier := 0, 1
+	for i := 0; ; i += 1 {
+		digit, err := c.reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, ErrMQTTPacket
+		}
+	}
+	if n > mqttMaxPacket {
+		return 0, nil, ErrMQTTPacket
+	}
+
+	body := make([]byte, n)
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// sends the connect packet and waits for the broker to accept it
+func (c *mqttClient) connect(clientId, username, password string, keepalive time.Duration) error {
+	flags := byte(0x02) // clean session
+	if username != "" {
+		flags |= 0x80
+	}
+	if password != "" {
+		flags |= 0x40
+	}
+
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, flags, byte(int(keepalive.Seconds())>>8), byte(int(keepalive.Seconds())))
+	body = appendString(body, clientId)
+	if username != "" {
+		body = appendString(body, username)
+	}
+	if password != "" {
+		body = appendString(body, password)
+	}
+	if err := c.write(mqttConnect<<4, body); err != nil {
+		return err
+	}
+
+	header, body, err := c.read()
+	if err != nil {
+		return err
+	}
+	if header>>4 != mqttConnack || len(body) != 2 {
+		return ErrMQTTPacket
+	}
+	if body[1] != 0 {
+		return fmt.Errorf("mqtt broker refused connection (code %d)", body[1])
+	}
+	return nil
+}
+
+// subscribes to the topics, the broker confirms this asynchronously
+func (c *mqttClient) subscribe(topics []string, qos []byte) error {
+	c.nextId += 1
+	body := []byte{byte(c.nextId >> 8), byte(c.nextId)}
+	for i, topic := range topics {
+		body = appendString(body, topic)
+		body = append(body, qos[i])
+	}
+	return c.write(mqttSubscribe<<4|0x02, body)
+}
+
+func (c *mqttClient) publish(msg *mqttMessage) error {
+	header := byte(mqttPublish << 4)
+	if msg.retain {
+		header |= 0x01
+	}
+	body := appendString(nil, msg.topic)
+	body = append(body, msg.payload...)
+	return c.write(header, body)
+}
+
+func (c *mqttClient) ping() error {
+	return c.write(mqttPingreq<<4, nil)
+}
+
+func (c *mqttClient) disconnect() {
+	c.write(mqttDisconnect<<4, nil)
+	c.conn.Close()
+}
+
+// waits for the next message published by the broker, acknowledging it
+// if needed. Other packets are handled or ignored.
+func (c *mqttClient) receive() (*mqttMessage, error) {
+	for {
+		header, body, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+
+		switch header >> 4 {
+		case mqttPublish:
+			msg := &mqttMessage{
+				qos:    (header >> 1) & 0x03,
+				retain: header&0x01 != 0,
+			}
+			if msg.topic, body, err = readString(body); err != nil {
+				return nil, err
+			}
+			if msg.qos > 0 {
+				if len(body) < 2 {
+					return nil, ErrMQTTPacket
+				}
+				if err := c.write(mqttPuback<<4, body[:2]); err != nil {
+					return nil, err
+				}
+				body = body[2:]
+			}
+			msg.payload = body
+			return msg, nil
+		case mqttSuback:
+			if len(body) < 2 {
+				return nil, ErrMQTTPacket
+			}
+			for _, code := range body[2:] {
+				if code == 0x80 {
+					return nil, errors.New("mqtt broker refused subscription")
+				}
+			}
+		case mqttPingresp, mqttPuback:
+		default:
+			return nil, ErrMQTTPacket
+		}
+	}
+}
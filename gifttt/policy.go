@@ -0,0 +1,214 @@
+package gifttt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	_policy *RunPolicy
+
+	// the options of ulimit used to set the limits of a command
+	ulimitOptions = map[string]string{
+		"cpu":      "-t",
+		"files":    "-n",
+		"memory":   "-v",
+		"filesize": "-f",
+	}
+)
+
+// A RunPolicy restricts the commands that can be executed by rules with
+// "run". Only the commands listed can be executed, with the environment
+// variables listed.
+type RunPolicy struct {
+	Commands []*CommandPolicy `json:"commands"`
+	// the working directory of all commands, unless they have their own
+	Dir string `json:"dir"`
+	// the environment passed to the commands, either as "NAME=value" or
+	// "NAME" to pass on the value gifttt has been started with
+	Env []string `json:"env"`
+	// how many commands can run at the same time (0 means no limit),
+	// further commands wait until one of them has finished
+	MaxProcesses int `json:"max_processes"`
+
+	slots chan bool
+}
+
+// A CommandPolicy allows a single command to be executed
+type CommandPolicy struct {
+	// the command as given to "run", e.g. "ping" or "/usr/bin/ping"
+	Command string `json:"command"`
+	// regular expressions, every argument has to match one of them. If
+	// not set, all arguments are allowed.
+	Args []string `json:"args"`
+	Dir  string   `json:"dir"`
+	// the user the command is executed as
+	User string `json:"user"`
+	// limits for the resources of the command, in the units of ulimit
+	Limits map[string]uint64 `json:"limits"`
+
+	args []*regexp.Regexp
+}
+
+func LoadRunPolicy(path string) (*RunPolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &RunPolicy{}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	for _, c := range policy.Commands {
+		if c.Command == "" {
+			return nil, fmt.Errorf("%s: missing command", path)
+		}
+		for _, arg := range c.Args {
+			re, err := regexp.Compile("^(?:" + arg + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", path, err.Error())
+			}
+			c.args = append(c.args, re)
+		}
+		for name := range c.Limits {
+			if _, ok := ulimitOptions[name]; !ok {
+				return nil, fmt.Errorf("%s: unknown limit '%s' for command '%s'", path, name, c.Command)
+			}
+		}
+	}
+
+	if policy.MaxProcesses < 0 {
+		return nil, fmt.Errorf("%s: max_processes can not be negative", path)
+	}
+	if policy.MaxProcesses > 0 {
+		policy.slots = make(chan bool, policy.MaxProcesses)
+	}
+	return policy, nil
+}
+
+// SetRunPolicy restricts all further commands executed by rules to the
+// policy, nil allows all commands
+func SetRunPolicy(p *RunPolicy) {
+	_policy = p
+}
+
+func GetRunPolicy() *RunPolicy {
+	return _policy
+}
+
+// returns the policy of the command, if the command and its arguments
+// are allowed
+func (p *RunPolicy) find(args []string) (*CommandPolicy, error) {
+	for _, c := range p.Commands {
+		if c.Command != args[0] {
+			continue
+		}
+		if c.Args == nil {
+			return c, nil
+		}
+
+		allowed := true
+		for _, arg := range args[1:] {
+			matched := false
+			for _, re := range c.args {
+				matched = matched || re.MatchString(arg)
+			}
+			allowed = allowed && matched
+		}
+		if allowed {
+			return c, nil
+		}
+	}
+
+	if len(args) > 1 {
+		return nil, fmt.Errorf("command '%s' with arguments %s is not allowed by the run policy", args[0], strings.Join(args[1:], ","))
+	}
+	return nil, fmt.Errorf("command '%s' is not allowed by the run policy", args[0])
+}
+
+// command creates the command for the arguments given to "run", or
+// returns an error if the policy does not allow it
+func (p *RunPolicy) command(args []string) (*exec.Cmd, error) {
+	c, err := p.find(args)
+	if err != nil {
+		return nil, err
+	}
+
+	// the command is looked up before the environment is replaced,
+	// which might not contain a path
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var cmd *exec.Cmd
+	if len(c.Limits) > 0 {
+		names := []string{}
+		for name := range c.Limits {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		script := []string{}
+		for _, name := range names {
+			script = append(script, "ulimit "+ulimitOptions[name]+" "+strconv.FormatUint(c.Limits[name], 10))
+		}
+		script = append(script, `exec "$@"`)
+		cmd = exec.Command("/bin/sh", append([]string{"-c", strings.Join(script, " && "), args[0], path}, args[1:]...)...)
+	} else {
+		cmd = exec.Command(path, args[1:]...)
+	}
+
+	cmd.Dir = p.Dir
+	if c.Dir != "" {
+		cmd.Dir = c.Dir
+	}
+
+	cmd.Env = []string{}
+	for _, env := range p.Env {
+		if strings.Contains(env, "=") {
+			cmd.Env = append(cmd.Env, env)
+		} else if value, ok := os.LookupEnv(env); ok {
+			cmd.Env = append(cmd.Env, env+"="+value)
+		}
+	}
+
+	setProcessGroup(cmd)
+	if c.User != "" {
+		if err := setUser(cmd, c.User); err != nil {
+			return nil, err
+		}
+	}
+	return cmd, nil
+}
+
+// waits until another command can be started, returns false if expired
+// fires first
+func (p *RunPolicy) acquire(expired <-chan time.Time) bool {
+	if p.slots == nil {
+		return true
+	}
+
+	select {
+	case p.slots <- true:
+		return true
+	case <-expired:
+		return false
+	}
+}
+
+func (p *RunPolicy) release() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
@@ -0,0 +1,193 @@
+//go:build !windows
+// +build !windows
+
+package gifttt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loads the policy from a temporary file
+func testPolicy(t *testing.T, config string) (*RunPolicy, error) {
+	dir, err := ioutil.TempDir("", "gifttt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "policy.json")
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadRunPolicy(path)
+}
+
+func TestLoadRunPolicy(t *testing.T) {
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{`{"commands": [{"command": "ping", "args": ["-c", "[0-9]+"]}]}`, ""},
+		{`{"commands": [{"command": "ping", "limits": {"cpu": 1, "memory": 1024}}]}`, ""},
+		{`{"commands": [], "max_processes": 2}`, ""},
+		{`{"commands": [{"args": ["-c"]}]}`, "missing command"},
+		{`{"commands": [{"command": "ping", "args": ["("]}]}`, "missing closing )"},
+		{`{"commands": [{"command": "ping", "limits": {"disk": 1}}]}`, "unknown limit 'disk'"},
+		{`{"max_processes": -1}`, "max_processes can not be negative"},
+		{`{"commands": {}}`, "cannot unmarshal"},
+	}
+	for _, test := range tests {
+		_, err := testPolicy(t, test.config)
+		if (test.err == "" && err != nil) || (test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err))) {
+			t.Errorf("%s returned %v, expected %q", test.config, err, test.err)
+		}
+	}
+}
+
+func TestPolicyFind(t *testing.T) {
+	policy, err := testPolicy(t, `{"commands": [
+		{"command": "ping", "args": ["-c", "[0-9]+", "[a-z.]+"]},
+		{"command": "ping", "args": ["-6", "[a-z.]+"], "user": "nobody"},
+		{"command": "uptime"},
+		{"command": "reboot", "args": []}
+	]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args []string
+		// the index of the command policy, -1 if not allowed
+		index int
+	}{
+		{[]string{"ping", "-c", "1", "example.com"}, 0},
+		{[]string{"ping", "example.com"}, 0},
+		{[]string{"ping", "-6", "example.com"}, 1},
+		{[]string{"ping", "-c", "1", "-6", "example.com"}, -1},
+		// arguments have to match as a whole
+		{[]string{"ping", "-c", "1", "example.com; reboot"}, -1},
+		{[]string{"ping", "-c", "1x", "example.com"}, -1},
+		{[]string{"uptime"}, 2},
+		{[]string{"uptime", "-p"}, 2},
+		{[]string{"reboot"}, 3},
+		{[]string{"reboot", "-f"}, -1},
+		{[]string{"/sbin/reboot"}, -1},
+		{[]string{"rm", "-rf", "/"}, -1},
+	}
+	for _, test := range tests {
+		c, err := policy.find(test.args)
+		if test.index < 0 {
+			if err == nil {
+				t.Errorf("%q is allowed", test.args)
+			}
+			continue
+		}
+		if err != nil || c != policy.Commands[test.index] {
+			t.Errorf("%q matches %+v (%v), expected command %d", test.args, c, err, test.index)
+		}
+	}
+}
+
+func TestPolicyCommand(t *testing.T) {
+	defer testStore(t)()
+	defer SetRunPolicy(nil)
+
+	dir, err := ioutil.TempDir("", "gifttt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+
+	os.Setenv("GIFTTT_TEST", "passed on")
+	defer os.Unsetenv("GIFTTT_TEST")
+
+	policy, err := testPolicy(t, `{
+		"commands": [
+			{"command": "pwd"},
+			{"command": "env"},
+			{"command": "sh", "args": ["-c", "ulimit -n"], "dir": "/", "limits": {"files": 64}}
+		],
+		"dir": "`+dir+`",
+		"env": ["GIFTTT_TEST", "GIFTTT_SET=1", "GIFTTT_MISSING"]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetRunPolicy(policy)
+
+	tests := []struct {
+		source string
+		result []interface{}
+	}{
+		{`(set result (run "pwd"))`, []interface{}{int64(0), dir + "\n", ""}},
+		{`(set result (run "env"))`, []interface{}{int64(0), "GIFTTT_TEST=passed on\nGIFTTT_SET=1\n", ""}},
+		{`(set result (run "sh" "-c" "ulimit -n"))`, []interface{}{int64(0), "64\n", ""}},
+	}
+	for _, test := range tests {
+		if err := runRule(t, test.source); err != nil {
+			t.Errorf("%s: %s", test.source, err.Error())
+			continue
+		}
+		if result, _ := GetManager().Get("result"); !reflect.DeepEqual(result, test.result) {
+			t.Errorf("%s = %#v, expected %#v", test.source, result, test.result)
+		}
+	}
+
+	if err := runRule(t, `(run "sh" "-c" "echo not allowed")`); err == nil || !strings.Contains(err.Error(), "not allowed by the run policy") {
+		t.Errorf("run returned %v for a command that is not allowed", err)
+	}
+}
+
+func TestPolicyMaxProcesses(t *testing.T) {
+	defer testStore(t)()
+	defer SetRunPolicy(nil)
+
+	policy, err := testPolicy(t, `{"commands": [{"command": "sleep"}], "max_processes": 1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetRunPolicy(policy)
+
+	// the second command waits for the first one to finish
+	start := time.Now()
+	done := make(chan error, 2)
+	for i := 0; i < 2; i += 1 {
+		go func() {
+			done <- runRule(t, `(run "sleep" "0.2")`)
+		}()
+	}
+	for i := 0; i < 2; i += 1 {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("both commands finished after %s", d)
+	}
+
+	// the time waiting to be started counts against the timeout
+	go func() {
+		done <- runRule(t, `(run "sleep" "1")`)
+	}()
+	for len(policy.slots) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	start = time.Now()
+	err = runRule(t, `(run :timeout "100ms" "sleep" "0")`)
+	if err == nil || !strings.Contains(err.Error(), "has not been started within 100ms") {
+		t.Errorf("waiting command returned %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("waiting command gave up after %s", d)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build windows
+// +build windows
+
+package gifttt
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// there are no process groups on windows, only the command itself is
+// killed
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
+
+func setUser(cmd *exec.Cmd, name string) error {
+	return errors.New("executing commands as another user is not supported on windows")
+}
@@ -0,0 +1,164 @@
+package gifttt
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	// wait until there is room in the queue
+	PolicyBlock = "block"
+	// drop the oldest change to make room for the new one
+	PolicyDropOldest = "drop-oldest"
+	// replace a queued change of the same variable with the new one, if
+	// there is none wait until there is room in the queue
+	PolicyCoalesce = "coalesce"
+
+	DefaultQueueSize = 1024
+)
+
+var (
+	ErrQueuePolicy = errors.New("unknown queue policy")
+	ErrQueueSize   = errors.New("queue size has to be at least 1")
+)
+
+// The EventQueue holds the changes of variables until the rule manager
+// is ready to process them. It is bounded, so what happens if changes
+// come in faster than they can be processed is defined by its policy.
+type EventQueue struct {
+	lock     *sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	events   []*Value
+	size     int
+	policy   string
+	stats    QueueStats
+}
+
+// counters describing what happened to the changes passing the queue
+type QueueStats struct {
+	Size      int    `json:"size"`
+	Policy    string `json:"policy"`
+	Queued    int    `json:"queued"`
+	Received  uint64 `json:"received"`
+	Processed uint64 `json:"processed"`
+	Dropped   uint64 `json:"dropped"`
+	Coalesced uint64 `json:"coalesced"`
+	Blocked   uint64 `json:"blocked"`
+}
+
+func NewEventQueue(size int, policy string) (*EventQueue, error) {
+	if size < 1 {
+		return nil, ErrQueueSize
+	}
+
+	switch policy {
+	case PolicyBlock, PolicyDropOldest, PolicyCoalesce:
+	default:
+		return nil, ErrQueuePolicy
+	}
+
+	lock := &sync.Mutex{}
+	return &EventQueue{
+		lock:     lock,
+		notEmpty: sync.NewCond(lock),
+		notFull:  sync.NewCond(lock),
+		events:   []*Value{},
+		size:     size,
+		policy:   policy,
+	}, nil
+}
+
+// Wait blocks until there is room in the queue for a change of the
+// variable, unless the policy makes room itself. It is called before the
+// change is made, so that no locks are held while waiting. Changes made
+// by rules never wait.
+func (q *EventQueue) Wait(name string) {
+	if q.policy == PolicyDropOldest {
+		return
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	blocked := false
+	for len(q.events) >= q.size && !(q.policy == PolicyCoalesce && q.queued(name)) {
+		if !blocked {
+			q.stats.Blocked += 1
+			blocked = true
+		}
+		q.notFull.Wait()
+	}
+}
+
+// returns whether a change of the variable is queued, has to be called
+// with the lock held
+func (q *EventQueue) queued(name string) bool {
+	for _, e := range q.events {
+		if e.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Push adds a change to the queue, it never blocks. With the block and
+// coalesce policies the queue can grow beyond its size if the change was
+// made without waiting first (e.g. by a rule, which can not wait for
+// itself to finish).
+func (q *EventQueue) Push(v *Value) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.stats.Received += 1
+
+	if q.policy == PolicyCoalesce {
+		for i, e := range q.events {
+			if e.Name == v.Name {
+				q.events[i] = v
+				q.stats.Coalesced += 1
+				return
+			}
+		}
+	}
+
+	if len(q.events) >= q.size && q.policy == PolicyDropOldest {
+		q.events[0] = nil
+		q.events = q.events[1:]
+		q.stats.Dropped += 1
+	}
+
+	q.events = append(q.events, v)
+	q.notEmpty.Signal()
+}
+
+// Pop removes the oldest change from the queue, waits until there is
+// one if the queue is empty
+func (q *EventQueue) Pop() *Value {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for len(q.events) == 0 {
+		q.notEmpty.Wait()
+	}
+
+	v := q.events[0]
+	q.events[0] = nil
+	q.events = q.events[1:]
+	q.stats.Processed += 1
+	// a waiting change might not be made after all (e.g. because the
+	// value did not change), so every waiting change gets a chance
+	q.notFull.Broadcast()
+	return v
+}
+
+func (q *EventQueue) Stats() QueueStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	stats := q.stats
+	stats.Size = q.size
+	stats.Policy = q.policy
+	stats.Queued = len(q.events)
+	return stats
+}
@@ -0,0 +1,152 @@
+package gifttt
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// returns whether Wait for the variable returns before the queue is
+// popped, and pops it if it did not
+func waits(q *EventQueue, name string) bool {
+	done := make(chan bool)
+	go func() {
+		q.Wait(name)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return false
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	q.Pop()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		panic("Wait did not return after Pop")
+	}
+	return true
+}
+
+// returns the names of the queued changes, emptying the queue
+func popAll(q *EventQueue) []string {
+	names := []string{}
+	for q.Stats().Queued > 0 {
+		names = append(names, q.Pop().Name)
+	}
+	return names
+}
+
+func TestNewEventQueue(t *testing.T) {
+	if _, err := NewEventQueue(0, PolicyBlock); err != ErrQueueSize {
+		t.Errorf("size 0 returned %v", err)
+	}
+	if _, err := NewEventQueue(1, "drop-newest"); err != ErrQueuePolicy {
+		t.Errorf("unknown policy returned %v", err)
+	}
+	for _, policy := range []string{PolicyBlock, PolicyDropOldest, PolicyCoalesce} {
+		if _, err := NewEventQueue(1, policy); err != nil {
+			t.Errorf("%s returned %s", policy, err.Error())
+		}
+	}
+}
+
+func TestQueuePolicies(t *testing.T) {
+	tests := []struct {
+		policy string
+		// changes pushed to a queue of size 2
+		pushed []string
+		// whether a change of the variable has to wait afterwards
+		name  string
+		waits bool
+		// changes popped afterwards
+		popped []string
+	}{
+		{PolicyBlock, []string{"a"}, "a", false, []string{"a"}},
+		{PolicyBlock, []string{"a", "b"}, "a", true, []string{"b"}},
+		{PolicyDropOldest, []string{"a", "b"}, "c", false, []string{"a", "b"}},
+		{PolicyDropOldest, []string{"a", "b", "c"}, "d", false, []string{"b", "c"}},
+		{PolicyCoalesce, []string{"a", "b", "a"}, "a", false, []string{"a", "b"}},
+		{PolicyCoalesce, []string{"a", "b"}, "b", false, []string{"a", "b"}},
+		{PolicyCoalesce, []string{"a", "b"}, "c", true, []string{"b"}},
+	}
+	for _, test := range tests {
+		q, _ := NewEventQueue(2, test.policy)
+		for _, name := range test.pushed {
+			q.Push(&Value{Name: name})
+		}
+		if waits(q, test.name) != test.waits {
+			t.Errorf("%s %v: waiting for %s is %v", test.policy, test.pushed, test.name, !test.waits)
+		}
+		if popped := popAll(q); strings.Join(popped, ",") != strings.Join(test.popped, ",") {
+			t.Errorf("%s %v: popped %v, expected %v", test.policy, test.pushed, popped, test.popped)
+		}
+	}
+}
+
+// the newest change of a coalesced variable replaces the queued one in
+// its place
+func TestQueueCoalesce(t *testing.T) {
+	q, _ := NewEventQueue(2, PolicyCoalesce)
+	q.Push(&Value{Name: "a", Value: int64(1)})
+	q.Push(&Value{Name: "b", Value: int64(1)})
+	q.Push(&Value{Name: "a", Value: int64(2)})
+
+	if v := q.Pop(); v.Name != "a" || v.Value != int64(2) {
+		t.Errorf("popped %s = %v, expected a = 2", v.Name, v.Value)
+	}
+}
+
+// every change waiting for room gets a chance once there is room, as
+// not all of them are made
+func TestQueueWaiters(t *testing.T) {
+	q, _ := NewEventQueue(1, PolicyBlock)
+	q.Push(&Value{Name: "a"})
+
+	done := make(chan bool)
+	for _, name := range []string{"b", "c"} {
+		go func(name string) {
+			q.Wait(name)
+			done <- true
+		}(name)
+	}
+	for q.Stats().Blocked < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	q.Pop()
+	for i := 0; i < 2; i += 1 {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%d of 2 waiting changes got a chance", i)
+		}
+	}
+}
+
+func TestQueueStats(t *testing.T) {
+	tests := []struct {
+		policy string
+		stats  QueueStats
+	}{
+		// the changes made without waiting grow the queue beyond its size
+		{PolicyBlock, QueueStats{Size: 2, Policy: PolicyBlock, Queued: 2, Received: 4, Processed: 2, Blocked: 1}},
+		{PolicyDropOldest, QueueStats{Size: 2, Policy: PolicyDropOldest, Queued: 1, Received: 4, Processed: 1, Dropped: 2}},
+		{PolicyCoalesce, QueueStats{Size: 2, Policy: PolicyCoalesce, Queued: 1, Received: 4, Processed: 2, Coalesced: 1, Blocked: 1}},
+	}
+	for _, test := range tests {
+		q, _ := NewEventQueue(2, test.policy)
+		q.Push(&Value{Name: "a"})
+		q.Push(&Value{Name: "b"})
+		waits(q, "c")
+		q.Push(&Value{Name: "c"})
+		q.Push(&Value{Name: "b"})
+		q.Pop()
+
+		if stats := q.Stats(); stats != test.stats {
+			t.Errorf("%s: %+v, expected %+v", test.policy, stats, test.stats)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package gifttt
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"io"
@@ -8,8 +9,8 @@ import (
 	"log"
 	"math/rand"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -19,85 +20,66 @@ import (
 )
 
 var (
-	_manager  *VariableManager
-	varPrefix = "var~"
-)
-
-type VariableManager struct {
-	Updates chan *Value
-	cache   map[string]*Value
-}
-
-type Value struct {
-	Name  string      `json:"-"`
-	Value interface{} `json:"value"`
-}
-
-func GetManager() *VariableManager {
-	if _manager == nil {
-		_manager = &VariableManager{
-			Updates: make(chan *Value),
-			cache:   make(map[string]*Value),
-		}
-	}
-	return _manager
-}
-
-func (vm *VariableManager) Get(name string) (interface{}, error) {
-	// check cache first
-	if v, ok := vm.cache[name]; ok {
-		return v.Value, nil
-	}
-
-	store := GetStore()
-	b, err := store.Get(varPrefix + name)
-	if err != nil {
-		return nil, nil
+	_rules *RuleManager
+
+	// functions that are available in rules in addition to the ones
+	// defined by twik
+	builtins = map[string]interface{}{
+		"log":          logFn,
+		"history":      historyFn,
+		"avg":          avgFn,
+		"min":          minFn,
+		"max":          maxFn,
+		"delta":        deltaFn,
+		"rate":         rateFn,
+		"cancel-timer": cancelTimerFn,
+		"list":         listFn,
+		"object":       objectFn,
 	}
 
-	v := &Value{}
-	if err := json.Unmarshal([]byte(b), v); err == nil {
-		return v.Value, nil
-	} else {
-		return nil, err
-	}
+	DefaultMaxCascade = 16
 
-	panic("never reached")
-}
-
-func (vm *VariableManager) Set(name string, value interface{}) error {
-	// check if the value has changed since the last time we set it
-	old, err := vm.Get(name)
-	if err == nil && old == value {
-		return nil
-	}
-
-	v := &Value{Value: value, Name: name}
-	b, err := json.Marshal(v)
-	if err != nil {
-		return err
-	}
-
-	store := GetStore()
-	vm.cache[name] = v
-	vm.Updates <- v
-	return store.Set(varPrefix+name, string(b))
-}
+	ErrRuleNotFound = errors.New("rule not found")
+	ErrRuleName     = errors.New("invalid rule name")
+	ErrRuleClosed   = errors.New("rule has been closed")
+)
 
 // the GlobalScope encapsulated over the DefaultScope of the LISP
 // interpreter. Get/Set will be delegated to it, so we can answer
 // with the data in the VariableManager
 type GlobalScope struct {
 	fset *ast.FileSet
+	// the id of the current evaluation, used in the log
+	session string
+	// the source code the evaluated nodes have been parsed from
+	source string
+	// the local names used by the actions of "after"
+	captures map[ast.Pos][]string
+	// the change that caused the rule to be evaluated
+	trigger *Value
+	// the last value of the conditions given to "rising" and "falling"
+	edges map[ast.Pos]bool
+	// the conditions given to "for-duration" that are currently true
+	holds map[ast.Pos]*hold
+	// the rule this scope belongs to
+	rule *Rule
 }
 
 func (s *GlobalScope) Create(symbol string, value interface{}) error {
 	panic("never reached")
 }
 
+// all changes made by the rule are marked as such, also the ones made
+// without a triggering change (by timers, schedules and "for-duration"),
+// so that they never wait for room in the queue while holding the rule
 func (s *GlobalScope) Set(symbol string, value interface{}) error {
+	depth := 0
+	if s.trigger != nil {
+		depth = s.trigger.Depth + 1
+	}
+
 	manager := GetManager()
-	return manager.Set(symbol, value)
+	return manager.cascade(symbol, value, depth)
 }
 
 func (s *GlobalScope) Get(symbol string) (interface{}, error) {
@@ -112,8 +94,12 @@ func (s *GlobalScope) Branch() twik.Scope {
 func (s *GlobalScope) Eval(node ast.Node) (interface{}, error) {
 	scope := twik.NewDefaultScope(s.fset)
 	scope.Enclose(s)
-	scope.Create("run", runFn)
-	scope.Create("log", logFn)
+	for name, fn := range builtins {
+		scope.Create(name, fn)
+	}
+	for name, fn := range s.functions() {
+		scope.Create(name, fn)
+	}
 	return scope.Eval(node)
 }
 
@@ -121,36 +107,6 @@ func (s *GlobalScope) Enclose(parent twik.Scope) error {
 	panic("never reached")
 }
 
-// "run" let's the user execute arbitrary commands
-func runFn(args []interface{}) (interface{}, error) {
-	if len(args) < 1 {
-		return nil, errors.New("run takes at least one argument")
-	}
-
-	commands := []string{}
-	for _, arg := range args {
-		if s, ok := arg.(string); ok {
-			commands = append(commands, s)
-		} else {
-			return nil, errors.New("run only takes string arguments")
-		}
-	}
-
-	var cmd *exec.Cmd
-	if len(commands) == 1 {
-		cmd = exec.Command(commands[0])
-	} else {
-		cmd = exec.Command(commands[0], commands[1:]...)
-	}
-	log.Printf("executing command '%s' with arguments: %s\n", commands[0], strings.Join(commands[1:], ","))
-
-	if err := cmd.Run(); err == nil {
-		cmd.Wait()
-	}
-
-	return nil, nil
-}
-
 // "log" a message
 func logFn(args []interface{}) (interface{}, error) {
 	if len(args) == 1 {
@@ -162,78 +118,76 @@ func logFn(args []interface{}) (interface{}, error) {
 	return nil, errors.New("log function takes a single string argument")
 }
 
-func NewGlobalScope(fset *ast.FileSet) twik.Scope {
-	scope := &GlobalScope{
-		fset: fset,
-	}
-	return scope
-}
-
-// this scope is trying to find out, which symbols (in gifttt variables)
-// there are, that might trigger on value change.
-type varScope struct {
-	variables chan string
+// "list" returns its arguments as list
+func listFn(args []interface{}) (interface{}, error) {
+	return args, nil
 }
 
-func (s *varScope) Create(name string, value interface{}) error {
-	panic("not reached")
-}
-
-func (s *varScope) Set(name string, value interface{}) error {
-	panic("not reached")
-}
-
-func (s *varScope) Get(name string) (interface{}, error) {
-	panic("not reached")
-}
-
-func (s *varScope) Branch() twik.Scope {
-	panic("not reached")
-}
+// "object" creates an object from pairs of names and values, e.g. to be
+// sent as JSON
+func objectFn(args []interface{}) (interface{}, error) {
+	if len(args)%2 != 0 {
+		return nil, errors.New("object function takes pairs of names and values")
+	}
 
-func (s *varScope) Enclose(scope twik.Scope) error {
-	panic("not reached")
+	object := make(map[string]interface{})
+	for i := 0; i < len(args); i += 2 {
+		name, ok := args[i].(string)
+		if !ok {
+			return nil, errors.New("object function takes names as strings")
+		}
+		object[name] = args[i+1]
+	}
+	return object, nil
 }
 
-func (s *varScope) Eval(node ast.Node) (interface{}, error) {
-	switch node := node.(type) {
-	case *ast.Symbol:
-		if node.Name == "log" || node.Name == "run" {
-			return nil, nil
-		}
-		for _, glb := range twik.Globals {
-			if node.Name == glb.Name {
-				return nil, nil
-			}
-		}
-		s.variables <- node.Name
-		return nil, nil
-	case *ast.Int:
-		return nil, nil
-	case *ast.Float:
-		return nil, nil
-	case *ast.String:
-		return nil, nil
-	case *ast.List:
-		for _, node := range node.Nodes {
-			s.Eval(node)
-		}
-		return nil, nil
-	case *ast.Root:
-		for _, node := range node.Nodes {
-			s.Eval(node)
-		}
-		close(s.variables)
-		return nil, nil
+// creates the scope to evaluate code of the rule in, which has been
+// parsed from source
+func newGlobalScope(fset *ast.FileSet, rule *Rule, source string) *GlobalScope {
+	return &GlobalScope{
+		fset:   fset,
+		source: source,
+		edges:  make(map[ast.Pos]bool),
+		holds:  make(map[ast.Pos]*hold),
+		rule:   rule,
 	}
-	return nil, nil
 }
 
 type Rule struct {
-	Name    string
+	// the name of the file the rule has been loaded from
+	File string
+	// the name of the rule, which is the file name unless the header
+	// specifies another one
+	Name        string
+	Description string
+	// the variables read by the rule, changes to them trigger it
+	Variables []string
+	// the variables the rule sets
+	Writes []string
+	// if set, only changes to these variables trigger the rule instead of
+	// all variables it reads
+	Triggers []string
+
+	// disabled rules are not evaluated
+	Enabled bool
+	// rules with higher priority are evaluated first
+	Priority int64
+	// changes within this time are coalesced into a single run of the rule
+	Debounce time.Duration
+	// if set, the rule is run at the times of the schedule, and only
+	// triggered by changes if it has explicit triggers
+	Schedule *Schedule
+
+	source  string
 	program ast.Node
-	scope   twik.Scope
+	scope   *GlobalScope
 	lock    *sync.Mutex
+	plock   *sync.Mutex
+	pending bool
+	// the latest change while a debounced run is pending
+	latest *Value
+	closed bool
+	timer  *time.Timer
 }
 
 func NewRule(name string, r io.Reader) (*Rule, error) {
@@ -243,85 +197,518 @@ func NewRule(name string, r io.Reader) (*Rule, error) {
 	}
 
 	fset := twik.NewFileSet()
-	scope := NewGlobalScope(fset)
-
 	node, err := twik.Parse(fset, name, data)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Rule{
+	rule := &Rule{
+		File:    name,
 		Name:    name,
-		program: node,
-		scope:   scope,
+		Enabled: true,
+		source:  string(data),
 		lock:    &sync.Mutex{},
-	}, nil
+		plock:   &sync.Mutex{},
+	}
+	rule.scope = newGlobalScope(fset, rule, rule.source)
+
+	// the header is not part of the program itself
+	if header := findHeader(node); header != nil {
+		if err := parseHeader(fset, rule, header); err != nil {
+			return nil, err
+		}
+
+		root := *node.(*ast.Root)
+		root.Nodes = root.Nodes[1:]
+		node = &root
+	}
+	rule.program = node
+	rule.scope.captures = captures(node)
+
+	// try to infer which variables are used by this rule, so that we can
+	// find out which rules need really to be triggered when a variable
+	// changes
+	rule.Variables, rule.Writes = analyze(node)
+	return rule, nil
+}
+
+func (r *Rule) MarshalJSON() ([]byte, error) {
+	info := struct {
+		File        string   `json:"file"`
+		Name        string   `json:"name"`
+		Description string   `json:"description,omitempty"`
+		Enabled     bool     `json:"enabled"`
+		Priority    int64    `json:"priority"`
+		Debounce    string   `json:"debounce,omitempty"`
+		Schedule    string   `json:"schedule,omitempty"`
+		Variables   []string `json:"variables"`
+		Writes      []string `json:"writes"`
+		Triggers    []string `json:"triggers"`
+	}{
+		File:        r.File,
+		Name:        r.Name,
+		Description: r.Description,
+		Enabled:     r.Enabled,
+		Priority:    r.Priority,
+		Variables:   r.Variables,
+		Writes:      r.Writes,
+		Triggers:    r.triggers(),
+	}
+	if r.Debounce > 0 {
+		info.Debounce = r.Debounce.String()
+	}
+	if r.Schedule != nil {
+		info.Schedule = r.Schedule.String()
+	}
+	return json.Marshal(info)
+}
+
+// returns the variables whose changes trigger the rule
+func (r *Rule) triggers() []string {
+	if r.Triggers != nil {
+		return r.Triggers
+	}
+	if r.Schedule != nil {
+		return []string{}
+	}
+	return r.Variables
 }
 
-func (r *Rule) Run() error {
+// returns the source code the rule has been created from
+func (r *Rule) Source() string {
+	return r.source
+}
+
+// evaluates the rule, trigger is the change that caused it (if any) and
+// session identifies this evaluation in the log
+func (r *Rule) Run(session string, trigger *Value) error {
 	r.lock.Lock()
 	defer r.lock.Unlock()
+	if r.isClosed() {
+		return ErrRuleClosed
+	}
+
+	r.scope.session = session
+	r.scope.trigger = trigger
 	_, err := r.scope.Eval(r.program)
+	r.scope.trigger = nil
 	return err
 }
 
+// Close marks the rule as closed, it will not be evaluated anymore
+// afterwards (even if one of its timers fires). Called when the rule is
+// replaced or removed.
+func (r *Rule) Close() {
+	r.plock.Lock()
+	defer r.plock.Unlock()
+	r.closed = true
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	for pos, h := range r.scope.holds {
+		h.timer.Stop()
+		delete(r.scope.holds, pos)
+	}
+}
+
+func (r *Rule) isClosed() bool {
+	r.plock.Lock()
+	defer r.plock.Unlock()
+	return r.closed
+}
+
+// schedules fn to be called with the latest change once the debounce time
+// of the rule has passed. Returns false if there is already a call
+// pending, in which case this change is coalesced into it.
+func (r *Rule) debounce(v *Value, fn func(latest *Value)) bool {
+	r.plock.Lock()
+	defer r.plock.Unlock()
+
+	r.latest = v
+	if r.pending {
+		return false
+	}
+
+	r.pending = true
+	time.AfterFunc(r.Debounce, func() {
+		r.plock.Lock()
+		latest := r.latest
+		r.pending = false
+		r.latest = nil
+		r.plock.Unlock()
+		fn(latest)
+	})
+	return true
+}
+
+// starts calling fn at the times of the rule's schedule in the given
+// location, until the rule is closed. Does nothing if the rule has no
+// schedule or it has already been started.
+func (r *Rule) schedule(loc *time.Location, fn func()) {
+	r.plock.Lock()
+	defer r.plock.Unlock()
+
+	if r.Schedule == nil || r.closed || r.timer != nil {
+		return
+	}
+	r.arm(time.Now().In(loc), fn)
+}
+
+// sets the timer for the first scheduled time after t, has to be called
+// with plock held
+func (r *Rule) arm(t time.Time, fn func()) {
+	next := r.Schedule.Next(t)
+	if next.IsZero() {
+		log.Printf("rule '%s' has no upcoming scheduled time\n", r.Name)
+		return
+	}
+
+	r.timer = time.AfterFunc(next.Sub(time.Now()), func() {
+		r.plock.Lock()
+		defer r.plock.Unlock()
+		if r.closed {
+			return
+		}
+
+		// the next time is computed from the scheduled one, so that no
+		// time is run twice or skipped if the timer fires early or late
+		go fn()
+		r.arm(next, fn)
+	})
+}
+
+// keeps track of a rule file on disk, so that we are able to detect
+// when it has been changed
+type ruleFile struct {
+	rule    *Rule
+	modtime time.Time
+	size    int64
+}
+
 type RuleManager struct {
-	rules map[string][]*Rule
+	// evaluate all rules triggered by a change at the same time, instead
+	// of one after another in the order of their priority
+	Parallel bool
+	// how many changes caused by rules can follow each other, before the
+	// rules are no longer triggered (0 means no limit)
+	MaxCascade int
+	// the location scheduled rules are run in and the time variables
+	// are computed for
+	Location *time.Location
+	// if set, the sun variables are computed for these coordinates
+	Coordinates *Coordinates
+
+	path    string
+	lock    *sync.RWMutex
+	files   map[string]*ruleFile
+	rules   map[string][]*Rule
+	running bool
+	tlock   *sync.Mutex
+	timers  map[string]*Timer
+	sun     *sunDay
+	// the cycles found by the last index, so that only new ones are
+	// reported
+	cycles map[string]bool
 }
 
 func NewRuleManager(path string) *RuleManager {
 	manager := &RuleManager{
-		rules: make(map[string][]*Rule),
+		MaxCascade: DefaultMaxCascade,
+		Location:   time.Local,
+		path:       path,
+		lock:       &sync.RWMutex{},
+		tlock:      &sync.Mutex{},
+		timers:     make(map[string]*Timer),
+		files:      make(map[string]*ruleFile),
+		rules:      make(map[string][]*Rule),
+		cycles:     make(map[string]bool),
 	}
 
-	files, _ := ioutil.ReadDir(path)
+	manager.reload()
+	_rules = manager
+
 	count := 0
+	for _, f := range manager.files {
+		if f.rule != nil {
+			count += 1
+		}
+	}
+	log.Printf("loaded %d rules\n", count)
+
+	return manager
+}
+
+func GetRuleManager() *RuleManager {
+	return _rules
+}
+
+func loadRule(filename, name string) (*Rule, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return NewRule(name, file)
+}
+
+// reload scans the rule directory for new, changed and removed rule files.
+// A rule that fails to parse is not replaced, so the previously working
+// version of it stays active until the error has been fixed.
+func (m *RuleManager) reload() {
+	files, err := ioutil.ReadDir(m.path)
+	if err != nil {
+		log.Printf("error reading rule directory '%s': %s\n", m.path, err.Error())
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	changed := false
+	seen := make(map[string]bool)
 	for _, f := range files {
-		if !f.IsDir() && strings.HasSuffix(f.Name(), ".rule") {
-			filename := filepath.Join(path, f.Name())
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".rule") {
+			continue
+		}
+		seen[f.Name()] = true
 
-			file, err := os.Open(filename)
-			if err != nil {
-				log.Printf("error opening '%s': %s\n", f.Name(), err.Error())
-				continue
-			}
+		rf, ok := m.files[f.Name()]
+		if ok && rf.modtime.Equal(f.ModTime()) && rf.size == f.Size() {
+			continue
+		}
+		if !ok {
+			rf = &ruleFile{}
+			m.files[f.Name()] = rf
+		}
 
-			rule, err := NewRule(f.Name(), file)
-			file.Close()
-			if err != nil {
-				log.Println(err)
-				continue
-			}
+		// remember the state of the file even if it could not be loaded,
+		// so we only report errors once per change
+		rf.modtime = f.ModTime()
+		rf.size = f.Size()
 
-			// try to infer which variables are used by this rule, so that we can
-			// find out which rules need really to be triggered when a variable
-			// changes
-			scope := &varScope{variables: make(chan string)}
-			go scope.Eval(rule.program)
-			for name := range scope.variables {
-				if _, ok := manager.rules[name]; !ok {
-					manager.rules[name] = []*Rule{}
-				}
-
-				rules := manager.rules[name]
-				var found bool
-				for _, r := range rules {
-					found = found || (r.Name == f.Name())
-					if found {
-						break
-					}
-				}
-
-				if !found {
-					manager.rules[name] = append(rules, rule)
-				}
-			}
-			count += 1
+		rule, err := loadRule(filepath.Join(m.path, f.Name()), f.Name())
+		if err != nil {
+			log.Printf("error loading '%s': %s\n", f.Name(), err.Error())
+			continue
+		}
+
+		if rf.rule != nil {
+			rf.rule.Close()
+			log.Printf("reloaded rule '%s'\n", f.Name())
 		}
+		rf.rule = rule
+		changed = true
 	}
-	log.Printf("loaded %d rules\n", count)
 
-	return manager
+	for name, rf := range m.files {
+		if seen[name] {
+			continue
+		}
+
+		delete(m.files, name)
+		if rf.rule != nil {
+			rf.rule.Close()
+			log.Printf("removed rule '%s'\n", name)
+			changed = true
+		}
+	}
+
+	if changed {
+		m.index()
+	}
+}
+
+// index rebuilds the mapping of variables to the rules that need to be
+// triggered when they change, ordered by their priority. Has to be called
+// with the lock held.
+func (m *RuleManager) index() {
+	rules := make(map[string][]*Rule)
+	for _, f := range m.files {
+		if f.rule == nil || !f.rule.Enabled {
+			continue
+		}
+
+		for _, name := range f.rule.triggers() {
+			rules[name] = append(rules[name], f.rule)
+		}
+	}
+
+	for _, r := range rules {
+		sort.Sort(byPriority(r))
+	}
+	m.rules = rules
+	if m.running {
+		m.schedule()
+	}
+
+	enabled := []*Rule{}
+	for _, f := range m.files {
+		if f.rule != nil && f.rule.Enabled {
+			enabled = append(enabled, f.rule)
+		}
+	}
+	// the same cycle is only reported again if it has been gone in between
+	cycles := make(map[string]bool)
+	for _, cycle := range findCycles(enabled) {
+		files := make([]string, len(cycle))
+		names := make([]string, len(cycle))
+		for i, r := range cycle {
+			files[i] = r.File
+			names[i] = "'" + r.Name + "'"
+		}
+
+		key := strings.Join(files, "/")
+		cycles[key] = true
+		if m.cycles[key] {
+			continue
+		}
+
+		if len(cycle) == 1 {
+			log.Printf("warning: rule '%s' triggers itself\n", cycle[0].Name)
+		} else {
+			log.Printf("warning: rules %s trigger each other in a cycle\n", strings.Join(names, ", "))
+		}
+	}
+	m.cycles = cycles
+}
+
+// returns all rules that depend on the given variable
+func (m *RuleManager) triggered(name string) []*Rule {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.rules[name]
+}
+
+// returns all loaded rules ordered by their file name
+func (m *RuleManager) Rules() []*Rule {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	rules := []*Rule{}
+	for _, f := range m.files {
+		if f.rule != nil {
+			rules = append(rules, f.rule)
+		}
+	}
+	sort.Sort(byFile(rules))
+	return rules
+}
+
+// returns the rule loaded from the file with the given name
+func (m *RuleManager) Rule(name string) (*Rule, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if f, ok := m.files[name]; ok && f.rule != nil {
+		return f.rule, nil
+	}
+	return nil, ErrRuleNotFound
+}
+
+// rule names are used as file names in the rule directory, so we
+// have to make sure they can not escape it
+func checkRuleName(name string) error {
+	if !strings.HasSuffix(name, ".rule") || strings.HasPrefix(name, ".") ||
+		strings.ContainsAny(name, "/\\") {
+		return ErrRuleName
+	}
+	return nil
+}
+
+// Put creates or replaces the rule with the given name. The rule is only
+// written to the rule directory if it can be parsed successfully.
+func (m *RuleManager) Put(name string, data []byte) error {
+	if err := checkRuleName(name); err != nil {
+		return err
+	}
+
+	rule, err := NewRule(name, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	filename := filepath.Join(m.path, name)
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	if rf, ok := m.files[name]; ok && rf.rule != nil {
+		rf.rule.Close()
+	}
+	m.files[name] = &ruleFile{
+		rule:    rule,
+		modtime: info.ModTime(),
+		size:    info.Size(),
+	}
+	m.index()
+
+	log.Printf("updated rule '%s'\n", name)
+	return nil
+}
+
+// Delete removes the rule with the given name from the rule directory
+func (m *RuleManager) Delete(name string) error {
+	if err := checkRuleName(name); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	rf, ok := m.files[name]
+	if !ok {
+		return ErrRuleNotFound
+	}
+
+	if err := os.Remove(filepath.Join(m.path, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if rf.rule != nil {
+		rf.rule.Close()
+	}
+	delete(m.files, name)
+	m.index()
+
+	log.Printf("removed rule '%s'\n", name)
+	return nil
+}
+
+type byFile []*Rule
+
+func (r byFile) Len() int           { return len(r) }
+func (r byFile) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byFile) Less(i, j int) bool { return r[i].File < r[j].File }
+
+// rules with the same priority are ordered by their file name, so the
+// order is always the same
+type byPriority []*Rule
+
+func (r byPriority) Len() int      { return len(r) }
+func (r byPriority) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byPriority) Less(i, j int) bool {
+	if r[i].Priority != r[j].Priority {
+		return r[i].Priority > r[j].Priority
+	}
+	return r[i].File < r[j].File
+}
+
+// Watch periodically checks the rule directory for changes and reloads
+// the affected rules. Never returns.
+func (m *RuleManager) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		m.reload()
+	}
 }
 
 func getSession() string {
@@ -334,47 +721,98 @@ func getSession() string {
 	return string(result)
 }
 
+// starts the schedules of all enabled rules that are not yet running, has
+// to be called with the lock held
+func (m *RuleManager) schedule() {
+	for _, f := range m.files {
+		if f.rule == nil || !f.rule.Enabled {
+			continue
+		}
+
+		rule := f.rule
+		rule.schedule(m.Location, func() {
+			session := getSession()
+			log.Printf("[%s] running scheduled rule '%s'\n", session, rule.Name)
+			m.execute(session, rule, nil)
+		})
+	}
+}
+
 func (m *RuleManager) Run() {
 	vm := GetManager()
 
+	m.lock.Lock()
+	m.running = true
+	m.schedule()
+	m.lock.Unlock()
+
+	if err := m.restoreTimers(); err != nil {
+		log.Printf("unable to restore timers: %s\n", err.Error())
+	}
+
 	// the rule manager keeps track of time
 	go func() {
 		ticker := time.NewTicker(time.Second)
-		for range ticker.C {
-			now := time.Now()
-			vm.Set("time:second", int64(now.Second()))
-			vm.Set("time:minute", int64(now.Minute()))
-			vm.Set("time:hour", int64(now.Hour()))
-			vm.Set("date:day", int64(now.Day()))
-			vm.Set("date:month", int64(now.Month()))
-			vm.Set("date:year", int64(now.Year()))
-			vm.Set("date:wday", int64(now.Weekday()))
+		for now := range ticker.C {
+			m.tick(now)
 		}
 	}()
 
+	// changes are processed in the order they happened, the next change is
+	// only taken from the queue once the rules triggered by the previous
+	// one have finished. If rules take longer to execute, the queue fills
+	// up and its policy decides what happens to further changes.
 	for {
-		v := <-vm.Updates
+		v := vm.Events.Pop()
+		if m.Parallel {
+			go m.dispatch(v)
+		} else {
+			m.dispatch(v)
+		}
+	}
+}
 
-		go func() {
-			session := getSession()
-			if _, ok := m.rules[v.Name]; !ok {
-				return
-			}
+// evaluates all rules that depend on the changed variable
+func (m *RuleManager) dispatch(v *Value) {
+	session := getSession()
+	rules := m.triggered(v.Name)
+	if len(rules) == 0 {
+		return
+	}
 
-			count := 0
-			for _, r := range m.rules[v.Name] {
-				go func() {
-					err := r.Run()
-					if err != nil {
-						log.Printf("[%s] error in '%s': %s\n", session, r.Name, err.Error())
-					} else {
-						log.Printf("[%s] executed rule '%s'\n", session, r.Name)
-					}
-				}()
-				count += 1
+	if m.MaxCascade > 0 && v.Depth > m.MaxCascade {
+		log.Printf("[%s] not executing rules for change in variable '%s': more than %d changes caused by rules in a row\n", session, v.Name, m.MaxCascade)
+		return
+	}
+
+	count := 0
+	for _, r := range rules {
+		if r.Debounce > 0 {
+			rule := r
+			if r.debounce(v, func(latest *Value) { m.execute(session, rule, latest) }) {
+				log.Printf("[%s] delaying rule '%s' by %s\n", session, r.Name, r.Debounce)
 			}
+			continue
+		}
 
-			log.Printf("[%s] executed %d rules for change in variable '%s' -> '%#v'\n", session, count, v.Name, v.Value)
-		}()
+		if m.Parallel {
+			go m.execute(session, r, v)
+		} else {
+			m.execute(session, r, v)
+		}
+		count += 1
+	}
+
+	log.Printf("[%s] executed %d rules for change in variable '%s' -> '%#v'\n", session, count, v.Name, v.Value)
+}
+
+func (m *RuleManager) execute(session string, r *Rule, trigger *Value) {
+	err := r.Run(session, trigger)
+	if err == ErrRuleClosed {
+		return
+	} else if err != nil {
+		log.Printf("[%s] error in '%s': %s\n", session, r.Name, err.Error())
+	} else {
+		log.Printf("[%s] executed rule '%s'\n", session, r.Name)
 	}
 }
@@ -0,0 +1,445 @@
+package gifttt
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDebounce(t *testing.T) {
+	rule, err := NewRule("test.rule", strings.NewReader(`(rule :debounce "20ms") (set y x)`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runs := make(chan *Value, 4)
+	for i, expected := range []bool{true, false, false} {
+		v := &Value{Name: "x", Value: int64(i)}
+		if started := rule.debounce(v, func(latest *Value) { runs <- latest }); started != expected {
+			t.Errorf("change %d started a run: %v", i, started)
+		}
+	}
+
+	select {
+	case v := <-runs:
+		if v.Value != int64(2) {
+			t.Errorf("debounced run got change %v, expected the latest one", v.Value)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("debounced run did not happen")
+	}
+
+	select {
+	case v := <-runs:
+		t.Errorf("second run with change %v", v.Value)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the next change starts a new run
+	if !rule.debounce(&Value{Name: "x", Value: int64(3)}, func(latest *Value) { runs <- latest }) {
+		t.Error("change after the run did not start a new one")
+	}
+	if v := <-runs; v.Value != int64(3) {
+		t.Errorf("debounced run got change %v", v.Value)
+	}
+}
+
+func TestForDurationClose(t *testing.T) {
+	defer testStore(t)()
+	_, cleanup := testRuleManager(t)
+	defer cleanup()
+	vm := GetManager()
+
+	source := `(for-duration "50ms" (== door "open") (set alarm true))`
+	if err := vm.Set("door", "open"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the rule runs again once the condition has held for the duration
+	rule, err := NewRule("held.rule", strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rule.Run("test", nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "alarm", true)
+	rule.Close()
+
+	// closing the rule stops its pending holds
+	if err := vm.Set("alarm", false); err != nil {
+		t.Fatal(err)
+	}
+	rule, err = NewRule("closed.rule", strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rule.Run("test", nil); err != nil {
+		t.Fatal(err)
+	}
+	rule.Close()
+	if len(rule.scope.holds) != 0 {
+		t.Errorf("%d holds left after closing the rule", len(rule.scope.holds))
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if alarm, _ := vm.Get("alarm"); alarm != false {
+		t.Errorf("alarm = %v after the rule has been closed", alarm)
+	}
+}
+
+// changes made by rules without a trigger (e.g. by timers) must not wait
+// for room in the queue, as the rule can only be triggered again once
+// they are done
+func TestRuleChangesDoNotWait(t *testing.T) {
+	defer testStore(t)()
+	m, cleanup := testRuleManager(t)
+	defer cleanup()
+
+	vm := GetManager()
+	events, _ := NewEventQueue(1, PolicyBlock)
+	vm.lock.Lock()
+	vm.Events = events
+	vm.lock.Unlock()
+
+	if err := m.Put("echo.rule", []byte(`(rule :on (x)) (set y x)`)); err != nil {
+		t.Fatal(err)
+	}
+	rule, _ := m.Rule("echo.rule")
+
+	// fill the queue and have another change wait for room
+	if err := vm.Set("x", int64(1)); err != nil {
+		t.Fatal(err)
+	}
+	go vm.Set("x", int64(2))
+	for events.Stats().Blocked == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// a timer of the rule sets a variable while the queue is full
+	done := make(chan error, 1)
+	go func() {
+		done <- rule.eval("test", "echo.rule[timer]", `(set z 1)`)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("change made by a timer waited for room in the queue")
+	}
+
+	// the waiting change is processed once the queue is emptied
+	go func() {
+		for {
+			m.dispatch(events.Pop())
+		}
+	}()
+	waitFor(t, "y", int64(2))
+	waitFor(t, "z", int64(1))
+}
+
+// the functions depending on the rule can be used in its program as well
+// as in the actions of its timers
+func TestScopeRule(t *testing.T) {
+	defer testStore(t)()
+	_, cleanup := testRuleManager(t)
+	defer cleanup()
+
+	rule, err := NewRule("scope.rule", strings.NewReader(`(set x 1)`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.scope.rule != rule {
+		t.Error("scope of the rule does not know the rule")
+	}
+
+	if err := rule.eval("test", "scope.rule[timer]", `(for-duration "1h" true (set y 1))`); err != nil {
+		t.Fatal(err)
+	}
+	rule.Close()
+}
+
+// returns the names of the files of all loaded rules
+func ruleFiles(m *RuleManager) string {
+	files := []string{}
+	for _, r := range m.Rules() {
+		files = append(files, r.File)
+	}
+	return strings.Join(files, ",")
+}
+
+func TestReload(t *testing.T) {
+	defer testStore(t)()
+	m, cleanup := testRuleManager(t)
+	defer cleanup()
+
+	// files are written with a new modification time every time, so that
+	// changes are seen even if the size stays the same
+	modtime := time.Now().Add(-time.Hour)
+	write := func(name, source string) {
+		filename := filepath.Join(m.path, name)
+		if err := ioutil.WriteFile(filename, []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modtime = modtime.Add(time.Second)
+		if err := os.Chtimes(filename, modtime, modtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// new files are added, other files and directories are ignored
+	write("a.rule", `(rule :on (x)) (set y x)`)
+	write("b.rule", `(rule :on (x)) (set z x)`)
+	write("c.txt", `(set y 1)`)
+	if err := os.Mkdir(filepath.Join(m.path, "d.rule"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	m.reload()
+	if files := ruleFiles(m); files != "a.rule,b.rule" {
+		t.Fatalf("loaded %s", files)
+	}
+	if rules := m.triggered("x"); len(rules) != 2 {
+		t.Errorf("x triggers %v", rules)
+	}
+	a, _ := m.Rule("a.rule")
+	b, _ := m.Rule("b.rule")
+
+	// files that did not change are not loaded again
+	m.reload()
+	if rule, _ := m.Rule("a.rule"); rule != a {
+		t.Error("a.rule has been loaded again without a change")
+	}
+
+	// changed files replace their rule
+	write("a.rule", `(rule :on (w)) (set y w)`)
+	m.reload()
+	replaced, _ := m.Rule("a.rule")
+	if replaced == a || !a.isClosed() {
+		t.Error("a.rule has not been replaced")
+	}
+	if rules := m.triggered("w"); len(rules) != 1 || rules[0] != replaced {
+		t.Errorf("w triggers %v", rules)
+	}
+	if rules := m.triggered("x"); len(rules) != 1 || rules[0] != b {
+		t.Errorf("x triggers %v", rules)
+	}
+
+	// a file that fails to parse keeps the previous rule
+	write("a.rule", `(rule :on (w)) (set y`)
+	m.reload()
+	if rule, _ := m.Rule("a.rule"); rule != replaced || replaced.isClosed() {
+		t.Error("a.rule has been replaced by a rule that failed to parse")
+	}
+	write("a.rule", `(rule :on (v)) (set y v)`)
+	m.reload()
+	if rule, _ := m.Rule("a.rule"); rule == replaced || !replaced.isClosed() {
+		t.Error("a.rule has not been replaced after the error has been fixed")
+	}
+
+	// a new file that fails to parse is not loaded
+	write("e.rule", `(set`)
+	m.reload()
+	if _, err := m.Rule("e.rule"); err != ErrRuleNotFound {
+		t.Errorf("e.rule returned %v", err)
+	}
+
+	// removed files remove their rule
+	if err := os.Remove(filepath.Join(m.path, "b.rule")); err != nil {
+		t.Fatal(err)
+	}
+	m.reload()
+	if files := ruleFiles(m); files != "a.rule" {
+		t.Errorf("loaded %s", files)
+	}
+	if !b.isClosed() {
+		t.Error("b.rule has not been closed")
+	}
+	if rules := m.triggered("x"); len(rules) != 0 {
+		t.Errorf("x triggers %v", rules)
+	}
+}
+
+func TestCheckRuleName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"lights.rule", true},
+		{"lights.on.rule", true},
+		{"lights", false},
+		{"lights.txt", false},
+		{".rule", false},
+		{".lights.rule", false},
+		{"../lights.rule", false},
+		{"rules/lights.rule", false},
+		{"/etc/lights.rule", false},
+		{"..\\lights.rule", false},
+	}
+	for _, test := range tests {
+		if err := checkRuleName(test.name); (err == nil) != test.valid {
+			t.Errorf("%s returned %v", test.name, err)
+		}
+	}
+}
+
+func TestPutDelete(t *testing.T) {
+	defer testStore(t)()
+	m, cleanup := testRuleManager(t)
+	defer cleanup()
+
+	source := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(m.path, name))
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+
+	if err := m.Put("../lights.rule", []byte(`(set x 1)`)); err != ErrRuleName {
+		t.Errorf("put ../lights.rule returned %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(m.path, "..", "lights.rule")); !os.IsNotExist(err) {
+		t.Error("put ../lights.rule wrote outside the rule directory")
+	}
+
+	// only rules that parse are written
+	if err := m.Put("lights.rule", []byte(`(set x`)); err == nil {
+		t.Error("put accepted a rule that does not parse")
+	}
+	if data := source("lights.rule"); data != "" {
+		t.Errorf("rule that does not parse has been written: %s", data)
+	}
+
+	if err := m.Put("lights.rule", []byte(`(rule :on (x)) (set y x)`)); err != nil {
+		t.Fatal(err)
+	}
+	old, err := m.Rule("lights.rule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := source("lights.rule"); data != `(rule :on (x)) (set y x)` {
+		t.Errorf("lights.rule is %q", data)
+	}
+
+	// a rule that does not parse keeps the previous one
+	if err := m.Put("lights.rule", []byte(`(set x`)); err == nil {
+		t.Error("put accepted a rule that does not parse")
+	}
+	if rule, _ := m.Rule("lights.rule"); rule != old || source("lights.rule") != `(rule :on (x)) (set y x)` {
+		t.Error("rule that does not parse replaced lights.rule")
+	}
+
+	if err := m.Put("lights.rule", []byte(`(rule :on (z)) (set y z)`)); err != nil {
+		t.Fatal(err)
+	}
+	if rule, _ := m.Rule("lights.rule"); rule == old || !old.isClosed() {
+		t.Error("lights.rule has not been replaced")
+	}
+	if rules := m.triggered("z"); len(rules) != 1 {
+		t.Errorf("z triggers %v", rules)
+	}
+
+	// the rule manager does not reload a rule it has written itself
+	rule, _ := m.Rule("lights.rule")
+	m.reload()
+	if r, _ := m.Rule("lights.rule"); r != rule {
+		t.Error("lights.rule has been loaded again")
+	}
+
+	if err := m.Delete("../lights.rule"); err != ErrRuleName {
+		t.Errorf("delete ../lights.rule returned %v", err)
+	}
+	if err := m.Delete("lights.rule"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(m.path, "lights.rule")); !os.IsNotExist(err) {
+		t.Error("lights.rule has not been removed")
+	}
+	if !rule.isClosed() {
+		t.Error("lights.rule has not been closed")
+	}
+	if rules := m.triggered("z"); len(rules) != 0 {
+		t.Errorf("z triggers %v", rules)
+	}
+	if err := m.Delete("lights.rule"); err != ErrRuleNotFound {
+		t.Errorf("deleting lights.rule again returned %v", err)
+	}
+}
+
+// rules triggered by the same change are run in the order of their
+// priority, and one has finished before the next one starts (unless they
+// are run in parallel)
+func TestDispatchOrder(t *testing.T) {
+	defer testStore(t)()
+	m, cleanup := testRuleManager(t)
+	defer cleanup()
+
+	lock := &sync.Mutex{}
+	order := []string{}
+	active, most := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		order = append(order, strings.TrimPrefix(r.URL.Path, "/"))
+		active += 1
+		if active > most {
+			most = active
+		}
+		lock.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		lock.Lock()
+		active -= 1
+		lock.Unlock()
+	}))
+	defer server.Close()
+
+	rules := map[string]string{
+		"low.rule":  `:priority -1`,
+		"b.rule":    `:priority 5`,
+		"a.rule":    `:priority 5`,
+		"high.rule": `:priority 10`,
+		"c.rule":    ``,
+		"off.rule":  `:priority 20 :enabled false`,
+	}
+	for name, header := range rules {
+		source := `(rule :on (x) ` + header + `) (http-get "` + server.URL + `/` + strings.TrimSuffix(name, ".rule") + `")`
+		if err := m.Put(name, []byte(source)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m.dispatch(&Value{Name: "x", Value: int64(1)})
+	lock.Lock()
+	if strings.Join(order, ",") != "high,a,b,c,low" || most != 1 {
+		t.Errorf("rules have been run in the order %v, %d at the same time", order, most)
+	}
+	order = []string{}
+	most = 0
+	lock.Unlock()
+	m.Parallel = true
+	m.dispatch(&Value{Name: "x", Value: int64(2)})
+	for i := 0; i < 100; i += 1 {
+		lock.Lock()
+		n := len(order)
+		lock.Unlock()
+		if n == 5 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(order) != 5 || most < 2 {
+		t.Errorf("rules have been run in parallel in the order %v, %d at the same time", order, most)
+	}
+}
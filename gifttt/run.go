@@ -0,0 +1,210 @@
+package gifttt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/drtoful/gifttt/Godeps/_workspace/src/github.com/drtoful/twik"
+	"github.com/drtoful/gifttt/Godeps/_workspace/src/github.com/drtoful/twik/ast"
+)
+
+var (
+	// how long commands started by "run" can take, unless the rule gives
+	// another timeout
+	DefaultRunTimeout = time.Minute
+
+	// how long the output of a killed command is read, processes started
+	// by it that left its process group can keep the output open
+	runKillWait = 5 * time.Second
+)
+
+// evaluates the arguments of a function and splits them into positional
+// arguments and options given as keywords (e.g. :timeout "10s"), only
+// the given keywords are accepted
+func evalArgs(fn string, scope twik.Scope, args []ast.Node, keywords ...string) ([]interface{}, map[string]interface{}, error) {
+	values := []interface{}{}
+	options := make(map[string]interface{})
+	for i := 0; i < len(args); i += 1 {
+		if symbol, ok := args[i].(*ast.Symbol); ok && strings.HasPrefix(symbol.Name, ":") {
+			known := false
+			for _, k := range keywords {
+				known = known || k == symbol.Name
+			}
+			if !known {
+				return nil, nil, fmt.Errorf(`function "%s" has no option %s`, fn, symbol.Name)
+			}
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf(`missing value for option %s of function "%s"`, symbol.Name, fn)
+			}
+
+			value, err := scope.Eval(args[i+1])
+			if err != nil {
+				return nil, nil, err
+			}
+			options[symbol.Name] = value
+			i += 1
+			continue
+		}
+
+		value, err := scope.Eval(args[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		values = append(values, value)
+	}
+	return values, options, nil
+}
+
+// returns the duration given as option, or def if it is not set
+func durationOption(fn string, options map[string]interface{}, key string, def time.Duration) (time.Duration, error) {
+	value, ok := options[key]
+	if !ok {
+		return def, nil
+	}
+
+	if s, ok := value.(string); ok {
+		if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf(`option %s of function "%s" takes a duration (e.g. "10s")`, key, fn)
+}
+
+// reads everything written to the returned pipe into buf, until all
+// processes holding it have closed it or the reading end is closed. The
+// returned channel is closed once done.
+func capture(buf *bytes.Buffer) (r *os.File, w *os.File, done chan bool, err error) {
+	r, w, err = os.Pipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	done = make(chan bool)
+	go func() {
+		io.Copy(buf, r)
+		close(done)
+	}()
+	return r, w, done, nil
+}
+
+// "run" executes a command and returns its exit status, standard output
+// and standard error as list. If the command does not finish within the
+// timeout, it is killed together with all processes it started and the
+// rule fails.
+func (s *GlobalScope) runFn(scope twik.Scope, args []ast.Node) (interface{}, error) {
+	values, options, err := evalArgs("run", scope, args, ":timeout")
+	if err != nil {
+		return nil, err
+	}
+	if len(values) < 1 {
+		return nil, errors.New("run takes at least one argument")
+	}
+
+	timeout, err := durationOption("run", options, ":timeout", DefaultRunTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	commands := []string{}
+	for _, arg := range values {
+		if s, ok := arg.(string); ok {
+			commands = append(commands, s)
+		} else {
+			return nil, errors.New("run only takes string arguments")
+		}
+	}
+
+	// the time a command waits to be started counts against its timeout,
+	// as the rule is held up all the same
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var cmd *exec.Cmd
+	policy := GetRunPolicy()
+	if policy != nil {
+		if cmd, err = policy.command(commands); err != nil {
+			return nil, err
+		}
+		if !policy.acquire(expired) {
+			log.Printf("[%s] command '%s' not started within %s\n", s.session, commands[0], timeout)
+			return nil, fmt.Errorf(`command "%s" has not been started within %s, too many commands are running`, commands[0], timeout)
+		}
+		defer policy.release()
+	} else {
+		cmd = exec.Command(commands[0], commands[1:]...)
+		setProcessGroup(cmd)
+	}
+
+	// the output is read through our own pipes, so that we can stop
+	// reading if the command has been killed but its output is kept open
+	var stdout, stderr bytes.Buffer
+	outR, outW, outDone, err := capture(&stdout)
+	if err != nil {
+		return nil, err
+	}
+	defer outR.Close()
+	errR, errW, errDone, err := capture(&stderr)
+	if err != nil {
+		outW.Close()
+		return nil, err
+	}
+	defer errR.Close()
+
+	cmd.Stdout = outW
+	cmd.Stderr = errW
+	log.Printf("[%s] executing command '%s' with arguments: %s\n", s.session, commands[0], strings.Join(commands[1:], ","))
+
+	// the command has its own copies of the writing ends
+	err = cmd.Start()
+	outW.Close()
+	errW.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		<-outDone
+		<-errDone
+		done <- err
+	}()
+
+	code := 0
+	select {
+	case err = <-done:
+	case <-expired:
+		killProcessGroup(cmd)
+		select {
+		case <-done:
+		case <-time.After(runKillWait):
+			outR.Close()
+			errR.Close()
+			<-done
+		}
+		log.Printf("[%s] command '%s' killed after %s\n", s.session, commands[0], timeout)
+		return nil, fmt.Errorf(`command "%s" has been killed after %s`, commands[0], timeout)
+	}
+
+	if exit, ok := err.(*exec.ExitError); ok {
+		if status, ok := exit.Sys().(syscall.WaitStatus); ok {
+			code = status.ExitStatus()
+		}
+		log.Printf("[%s] command '%s' failed: %s\n", s.session, commands[0], err.Error())
+	} else if err != nil {
+		return nil, err
+	}
+	return []interface{}{int64(code), stdout.String(), stderr.String()}, nil
+}
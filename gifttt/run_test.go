@@ -0,0 +1,85 @@
+//go:build !windows
+// +build !windows
+
+package gifttt
+
+import (
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	defer testStore(t)()
+
+	tests := []struct {
+		source string
+		result []interface{}
+	}{
+		{`(set result (run "true"))`, []interface{}{int64(0), "", ""}},
+		{`(set result (run "false"))`, []interface{}{int64(1), "", ""}},
+		{`(set result (run "echo" "a" "b"))`, []interface{}{int64(0), "a b\n", ""}},
+		{`(set result (run "sh" "-c" "echo out; echo err >&2; exit 3"))`, []interface{}{int64(3), "out\n", "err\n"}},
+		{`(set result (run :timeout "10s" "sh" "-c" "exit 42"))`, []interface{}{int64(42), "", ""}},
+	}
+	for _, test := range tests {
+		if err := runRule(t, test.source); err != nil {
+			t.Errorf("%s: %s", test.source, err.Error())
+			continue
+		}
+		if result, _ := GetManager().Get("result"); !reflect.DeepEqual(result, test.result) {
+			t.Errorf("%s = %#v, expected %#v", test.source, result, test.result)
+		}
+	}
+
+	invalid := []string{
+		`(run)`,
+		`(run 1)`,
+		`(run "true" :timeout)`,
+		`(run :timeout "soon" "true")`,
+		`(run :retries 1 "true")`,
+		`(run "/does/not/exist")`,
+	}
+	for _, source := range invalid {
+		if err := runRule(t, source); err == nil {
+			t.Errorf("%s did not return an error", source)
+		}
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	defer testStore(t)()
+
+	// the command is killed together with the processes it started,
+	// which would otherwise keep its output open
+	start := time.Now()
+	err := runRule(t, `(set result (run :timeout "100ms" "sh" "-c" "echo started; sleep 5 & sleep 5"))`)
+	if err == nil || !strings.Contains(err.Error(), `command "sh" has been killed after 100ms`) {
+		t.Errorf("killed command returned %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("command has been killed after %s", d)
+	}
+	if result, _ := GetManager().Get("result"); result != nil {
+		t.Errorf("result of a killed command is %#v", result)
+	}
+
+	// processes that left the process group are not killed, so the
+	// output is only read for a while
+	if _, err := exec.LookPath("setsid"); err != nil {
+		t.Skip("setsid is not available")
+	}
+	defer func(d time.Duration) { runKillWait = d }(runKillWait)
+	runKillWait = 100 * time.Millisecond
+
+	start = time.Now()
+	err = runRule(t, `(run :timeout "100ms" "sh" "-c" "setsid sleep 5 & sleep 5")`)
+	if err == nil || !strings.Contains(err.Error(), "has been killed") {
+		t.Errorf("killed command returned %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("command has been killed after %s", d)
+	}
+}
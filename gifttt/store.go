@@ -1,7 +1,10 @@
 package gifttt
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
+	"time"
 
 	"github.com/drtoful/gifttt/Godeps/_workspace/src/github.com/boltdb/bolt"
 )
@@ -11,13 +14,21 @@ const (
 )
 
 var (
-	_BUCKET        = []byte("gifttt")
-	_store  *Store = nil
+	_BUCKET         = []byte("gifttt")
+	_HISTORY        = []byte("history")
+	_COUNTS         = []byte("history-count")
+	_store   *Store = nil
 
 	ErrUnknownBucket = errors.New("bucket '" + string(_BUCKET) + "' does not exist")
 	ErrNotFound      = errors.New("key not found")
 )
 
+// a single entry in the history of a key
+type Entry struct {
+	Time  time.Time
+	Value string
+}
+
 type Store struct {
 	db   *bolt.DB
 	path string
@@ -48,6 +59,14 @@ func StoreInit(path string) error {
 		if err != nil {
 			return err
 		}
+		_, err = tx.CreateBucketIfNotExists(_HISTORY)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(_COUNTS)
+		if err != nil {
+			return err
+		}
 		return nil
 	})
 
@@ -99,3 +118,208 @@ func (store *Store) Get(key string) (value string, err error) {
 
 	return value, err
 }
+
+// delete a key, returns ErrNotFound if the key does not exist
+func (store *Store) Delete(key string) error {
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(_BUCKET)
+		if b == nil {
+			return ErrUnknownBucket
+		}
+		if b.Get([]byte(key)) == nil {
+			return ErrNotFound
+		}
+
+		return b.Delete([]byte(key))
+	})
+
+	return err
+}
+
+// get all keys (and their content) that start with the specified prefix
+func (store *Store) Scan(prefix string) (values map[string]string, err error) {
+	values = make(map[string]string)
+	err = store.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(_BUCKET)
+		if b == nil {
+			return ErrUnknownBucket
+		}
+
+		c := b.Cursor()
+		p := []byte(prefix)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			values[string(k)] = string(v)
+		}
+
+		return nil
+	})
+
+	return values, err
+}
+
+// history entries are kept in a separate bucket per key, ordered by the
+// time they have been added
+func timeKey(t time.Time) []byte {
+	b := make([]byte, 8)
+	if t.After(time.Unix(0, 0)) {
+		binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	}
+	return b
+}
+
+func keyTime(b []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+}
+
+// add a value to the history of a key. Afterwards only the newest count
+// entries that are not older than age are kept (0 means no limit).
+func (store *Store) AppendHistory(key string, t time.Time, value string, count int, age time.Duration) error {
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		return appendHistory(tx, key, t, value, count, age)
+	})
+
+	return err
+}
+
+// set a key to the specified value and add a value to the history of
+// another key (see AppendHistory), both in the same transaction
+func (store *Store) SetAndAppendHistory(key, value, hkey string, t time.Time, hvalue string, count int, age time.Duration) error {
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(_BUCKET)
+		if b == nil {
+			return ErrUnknownBucket
+		}
+		if err := b.Put([]byte(key), []byte(value)); err != nil {
+			return err
+		}
+		return appendHistory(tx, hkey, t, hvalue, count, age)
+	})
+
+	return err
+}
+
+func appendHistory(tx *bolt.Tx, key string, t time.Time, value string, count int, age time.Duration) error {
+	h := tx.Bucket(_HISTORY)
+	counts := tx.Bucket(_COUNTS)
+	if h == nil || counts == nil {
+		return ErrUnknownBucket
+	}
+	b, err := h.CreateBucketIfNotExists([]byte(key))
+	if err != nil {
+		return err
+	}
+
+	// the number of entries is kept separately, so that the history does
+	// not have to be counted every time a value is added
+	n := 0
+	if data := counts.Get([]byte(key)); data != nil {
+		n = int(binary.BigEndian.Uint64(data))
+	} else {
+		b.ForEach(func(k, v []byte) error {
+			n += 1
+			return nil
+		})
+	}
+
+	k := timeKey(t)
+	if b.Get(k) == nil {
+		n += 1
+	}
+	if err := b.Put(k, []byte(value)); err != nil {
+		return err
+	}
+
+	// the oldest entries are the ones no longer needed, they can not be
+	// deleted while iterating as this would invalidate the cursor
+	keys := [][]byte{}
+	limit := timeKey(t.Add(-age))
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if !(count > 0 && n-len(keys) > count) && !(age > 0 && bytes.Compare(k, limit) < 0) {
+			break
+		}
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(n-len(keys)))
+	return counts.Put([]byte(key), data)
+}
+
+// get all history entries of a key between from and to (inclusive)
+func (store *Store) History(key string, from, to time.Time) (entries []*Entry, err error) {
+	entries = []*Entry{}
+	err = store.db.View(func(tx *bolt.Tx) error {
+		h := tx.Bucket(_HISTORY)
+		if h == nil {
+			return ErrUnknownBucket
+		}
+		b := h.Bucket([]byte(key))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		limit := timeKey(to)
+		for k, v := c.Seek(timeKey(from)); k != nil && bytes.Compare(k, limit) <= 0; k, v = c.Next() {
+			entries = append(entries, &Entry{Time: keyTime(k), Value: string(v)})
+		}
+		return nil
+	})
+
+	return entries, err
+}
+
+// get the last history entry of a key before the given time, returns nil
+// if there is no such entry
+func (store *Store) Before(key string, t time.Time) (entry *Entry, err error) {
+	err = store.db.View(func(tx *bolt.Tx) error {
+		h := tx.Bucket(_HISTORY)
+		if h == nil {
+			return ErrUnknownBucket
+		}
+		b := h.Bucket([]byte(key))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		k, v := c.Seek(timeKey(t))
+		if k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+		if k != nil {
+			entry = &Entry{Time: keyTime(k), Value: string(v)}
+		}
+		return nil
+	})
+
+	return entry, err
+}
+
+// remove the complete history of a key
+func (store *Store) DeleteHistory(key string) error {
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		h := tx.Bucket(_HISTORY)
+		counts := tx.Bucket(_COUNTS)
+		if h == nil || counts == nil {
+			return ErrUnknownBucket
+		}
+		if h.Bucket([]byte(key)) == nil {
+			return nil
+		}
+		if err := counts.Delete([]byte(key)); err != nil {
+			return err
+		}
+		return h.DeleteBucket([]byte(key))
+	})
+
+	return err
+}
@@ -0,0 +1,57 @@
+package gifttt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScan(t *testing.T) {
+	defer testStore(t)()
+	store := GetStore()
+
+	for _, key := range []string{"a", "ab", "abc", "b", "ba"} {
+		if err := store.Set(key, key+"!"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		prefix string
+		values map[string]string
+	}{
+		{"", map[string]string{"a": "a!", "ab": "ab!", "abc": "abc!", "b": "b!", "ba": "ba!"}},
+		{"a", map[string]string{"a": "a!", "ab": "ab!", "abc": "abc!"}},
+		{"ab", map[string]string{"ab": "ab!", "abc": "abc!"}},
+		{"b", map[string]string{"b": "b!", "ba": "ba!"}},
+		{"c", map[string]string{}},
+		{"abcd", map[string]string{}},
+	}
+	for _, test := range tests {
+		values, err := store.Scan(test.prefix)
+		if err != nil {
+			t.Errorf("%q: %s", test.prefix, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(values, test.values) {
+			t.Errorf("%q: %v, expected %v", test.prefix, values, test.values)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	defer testStore(t)()
+	store := GetStore()
+
+	if err := store.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("a"); err != ErrNotFound {
+		t.Errorf("get of a deleted key returned %v", err)
+	}
+	if err := store.Delete("a"); err != ErrNotFound {
+		t.Errorf("deleting a again returned %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package gifttt
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// zenith of the sun at sunrise and sunset, including refraction and
+	// the radius of the sun
+	zenithSun = 90.833
+	// zenith of the sun at the start and end of the civil twilight
+	zenithCivil = 96.0
+)
+
+// the variables computed from the position of the sun, if the rule
+// manager has been given coordinates
+var sunVars = []string{
+	"sun:rise",
+	"sun:set",
+	"sun:dawn",
+	"sun:dusk",
+	"sun:up",
+}
+
+// Coordinates of the place gifttt runs at, in degrees (north and east
+// are positive)
+type Coordinates struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// the times of the sun on a day, in minutes since midnight (nil if the
+// sun does not rise or set on that day)
+type sunDay struct {
+	date                  time.Time
+	rise, set, dawn, dusk interface{}
+}
+
+func rad(deg float64) float64 { return deg * math.Pi / 180 }
+func deg(rad float64) float64 { return rad * 180 / math.Pi }
+
+// computes the declination of the sun and the equation of time (in
+// minutes) at the given time, see the NOAA solar calculator
+func solarPosition(t time.Time) (float64, float64) {
+	jd := float64(t.Unix())/86400 + 2440587.5
+	jc := (jd - 2451545) / 36525
+
+	meanLong := math.Mod(280.46646+jc*(36000.76983+jc*0.0003032), 360)
+	meanAnom := 357.52911 + jc*(35999.05029-0.0001537*jc)
+	eccent := 0.016708634 - jc*(0.000042037+0.0000001267*jc)
+	center := math.Sin(rad(meanAnom))*(1.914602-jc*(0.004817+0.000014*jc)) +
+		math.Sin(rad(2*meanAnom))*(0.019993-0.000101*jc) +
+		math.Sin(rad(3*meanAnom))*0.000289
+	omega := 125.04 - 1934.136*jc
+	appLong := meanLong + center - 0.00569 - 0.00478*math.Sin(rad(omega))
+	meanObliq := 23 + (26+(21.448-jc*(46.815+jc*(0.00059-jc*0.001813)))/60)/60
+	obliq := meanObliq + 0.00256*math.Cos(rad(omega))
+
+	decl := deg(math.Asin(math.Sin(rad(obliq)) * math.Sin(rad(appLong))))
+
+	y := math.Pow(math.Tan(rad(obliq/2)), 2)
+	eqTime := 4 * deg(y*math.Sin(2*rad(meanLong))-
+		2*eccent*math.Sin(rad(meanAnom))+
+		4*eccent*y*math.Sin(rad(meanAnom))*math.Cos(2*rad(meanLong))-
+		0.5*y*y*math.Sin(4*rad(meanLong))-
+		1.25*eccent*eccent*math.Sin(2*rad(meanAnom)))
+	return decl, eqTime
+}
+
+// returns the times the sun passes the given zenith on the day of date
+// (in date's location), as minutes since midnight
+func (c *Coordinates) sunTimes(date time.Time, zenith float64) (interface{}, interface{}) {
+	midnight := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	noon := midnight.Add(time.Duration((720 - 4*c.Longitude) * float64(time.Minute)))
+	decl, eqTime := solarPosition(noon)
+
+	cosHA := math.Cos(rad(zenith))/(math.Cos(rad(c.Latitude))*math.Cos(rad(decl))) -
+		math.Tan(rad(c.Latitude))*math.Tan(rad(decl))
+	if cosHA > 1 || cosHA < -1 {
+		// the sun stays above or below the zenith all day
+		return nil, nil
+	}
+
+	ha := deg(math.Acos(cosHA))
+	solarNoon := 720 - 4*c.Longitude - eqTime
+	minutes := func(m float64) interface{} {
+		t := midnight.Add(time.Duration(m * float64(time.Minute))).In(date.Location())
+		return int64(t.Hour()*60 + t.Minute())
+	}
+	return minutes(solarNoon - 4*ha), minutes(solarNoon + 4*ha)
+}
+
+// returns whether the sun is above the horizon at the given time
+func (c *Coordinates) sunUp(t time.Time) bool {
+	decl, eqTime := solarPosition(t)
+
+	t = t.UTC()
+	minutes := float64(t.Hour()*60+t.Minute()) + float64(t.Second())/60
+	ha := (minutes+eqTime+4*c.Longitude)/4 - 180
+
+	cosZenith := math.Sin(rad(c.Latitude))*math.Sin(rad(decl)) +
+		math.Cos(rad(c.Latitude))*math.Cos(rad(decl))*math.Cos(rad(ha))
+	return deg(math.Acos(cosZenith)) < zenithSun
+}
+
+// sets the sun variables for the given time, the times of the day are
+// only computed once per day
+func (m *RuleManager) tickSun(now time.Time) {
+	if m.Coordinates == nil {
+		return
+	}
+
+	y, mo, d := now.Date()
+	date := time.Date(y, mo, d, 0, 0, 0, 0, now.Location())
+	if m.sun == nil || !m.sun.date.Equal(date) {
+		day := &sunDay{date: date}
+		day.rise, day.set = m.Coordinates.sunTimes(now, zenithSun)
+		day.dawn, day.dusk = m.Coordinates.sunTimes(now, zenithCivil)
+		m.sun = day
+	}
+
+	vm := GetManager()
+	vm.Set("sun:rise", m.sun.rise)
+	vm.Set("sun:set", m.sun.set)
+	vm.Set("sun:dawn", m.sun.dawn)
+	vm.Set("sun:dusk", m.sun.dusk)
+	vm.Set("sun:up", m.Coordinates.sunUp(now))
+}
@@ -0,0 +1,114 @@
+package gifttt
+
+import (
+	"testing"
+	"time"
+)
+
+var (
+	zurich = &Coordinates{Latitude: 47.37, Longitude: 8.54}
+	tromso = &Coordinates{Latitude: 69.65, Longitude: 18.96}
+	cet    = time.FixedZone("CET", 60*60)
+	cest   = time.FixedZone("CEST", 2*60*60)
+)
+
+// returns the time of day as minutes since midnight
+func clock(hour, minute int) interface{} {
+	return int64(hour*60 + minute)
+}
+
+func TestSunTimes(t *testing.T) {
+	tests := []struct {
+		coords    *Coordinates
+		date      time.Time
+		zenith    float64
+		rise, set interface{}
+	}{
+		{zurich, time.Date(2015, 6, 21, 12, 0, 0, 0, cest), zenithSun, clock(5, 29), clock(21, 26)},
+		{zurich, time.Date(2015, 12, 21, 12, 0, 0, 0, cet), zenithSun, clock(8, 10), clock(16, 37)},
+		{zurich, time.Date(2015, 3, 20, 12, 0, 0, 0, cet), zenithSun, clock(6, 29), clock(18, 37)},
+		{zurich, time.Date(2015, 6, 21, 12, 0, 0, 0, cest), zenithCivil, clock(4, 50), clock(22, 5)},
+		// the sun does not set in summer and does not rise in winter
+		{tromso, time.Date(2015, 6, 21, 12, 0, 0, 0, cest), zenithSun, nil, nil},
+		{tromso, time.Date(2015, 12, 21, 12, 0, 0, 0, cet), zenithSun, nil, nil},
+	}
+	for _, test := range tests {
+		rise, set := test.coords.sunTimes(test.date, test.zenith)
+		if !near(rise, test.rise) || !near(set, test.set) {
+			t.Errorf("%v on %s at %.1f: %v to %v, expected %v to %v", test.coords, test.date.Format("2006-01-02"), test.zenith, rise, set, test.rise, test.set)
+		}
+	}
+}
+
+// the times may differ by a few minutes from other calculators
+func near(value, expected interface{}) bool {
+	v, ok1 := value.(int64)
+	e, ok2 := expected.(int64)
+	if !ok1 || !ok2 {
+		return value == expected
+	}
+	return v-e <= 3 && e-v <= 3
+}
+
+func TestSunUp(t *testing.T) {
+	tests := []struct {
+		coords *Coordinates
+		time   time.Time
+		up     bool
+	}{
+		{zurich, time.Date(2015, 6, 21, 12, 0, 0, 0, cest), true},
+		{zurich, time.Date(2015, 6, 21, 5, 0, 0, 0, cest), false},
+		{zurich, time.Date(2015, 6, 21, 6, 0, 0, 0, cest), true},
+		{zurich, time.Date(2015, 6, 21, 21, 0, 0, 0, cest), true},
+		{zurich, time.Date(2015, 6, 21, 22, 0, 0, 0, cest), false},
+		{zurich, time.Date(2015, 12, 21, 17, 0, 0, 0, cet), false},
+		{tromso, time.Date(2015, 6, 21, 1, 0, 0, 0, cest), true},
+		{tromso, time.Date(2015, 12, 21, 12, 0, 0, 0, cet), false},
+	}
+	for _, test := range tests {
+		if up := test.coords.sunUp(test.time); up != test.up {
+			t.Errorf("%v at %s: sun is up %v", test.coords, test.time, up)
+		}
+	}
+}
+
+func TestSunVars(t *testing.T) {
+	defer testStore(t)()
+	m, cleanup := testRuleManager(t)
+	defer cleanup()
+	vm := GetManager()
+
+	// without coordinates the variables are not set, and can be set by
+	// everyone
+	m.Location = cest
+	m.tick(time.Date(2015, 6, 21, 12, 0, 0, 0, cest))
+	if value, _ := vm.Get("sun:up"); value != nil {
+		t.Errorf("sun:up = %v without coordinates", value)
+	}
+	if isInternal("sun:up") {
+		t.Error("sun:up can not be set without coordinates")
+	}
+
+	m.Coordinates = zurich
+	m.tick(time.Date(2015, 6, 21, 12, 0, 0, 0, cest))
+	for _, name := range sunVars {
+		if !isInternal(name) {
+			t.Errorf("%s can be set with coordinates", name)
+		}
+	}
+	if value, _ := vm.Get("sun:up"); value != true {
+		t.Errorf("sun:up = %v at noon", value)
+	}
+	if value, _ := vm.Get("sun:rise"); !near(value, clock(5, 29)) {
+		t.Errorf("sun:rise = %v", value)
+	}
+
+	// the times are computed again on the next day
+	m.tick(time.Date(2015, 12, 21, 23, 0, 0, 0, cest))
+	if value, _ := vm.Get("sun:set"); !near(value, clock(17, 37)) {
+		t.Errorf("sun:set = %v in december (in CEST)", value)
+	}
+	if value, _ := vm.Get("sun:up"); value != false {
+		t.Errorf("sun:up = %v at night", value)
+	}
+}
@@ -0,0 +1,329 @@
+package gifttt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drtoful/gifttt/Godeps/_workspace/src/github.com/drtoful/twik"
+	"github.com/drtoful/gifttt/Godeps/_workspace/src/github.com/drtoful/twik/ast"
+)
+
+const (
+	timerPrefix = "timer~"
+)
+
+var (
+	ErrTimerNotFound = errors.New("timer not found")
+)
+
+// A Timer evaluates an action of a rule at a later time. Timers are kept
+// in the store, so that they survive a restart.
+type Timer struct {
+	Id string `json:"id"`
+	// the file of the rule that created the timer, the action is
+	// evaluated in the scope of this rule
+	Rule   string    `json:"rule"`
+	Action string    `json:"action"`
+	Due    time.Time `json:"due"`
+
+	timer *time.Timer
+}
+
+type byDue []*Timer
+
+func (t byDue) Len() int           { return len(t) }
+func (t byDue) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t byDue) Less(i, j int) bool { return t[i].Due.Before(t[j].Due) }
+
+// After starts a timer that evaluates action in the rule from the given
+// file once d has passed. If id is empty a new one is generated, an
+// existing timer with the same id is replaced.
+func (m *RuleManager) After(id, rule string, d time.Duration, action string) (*Timer, error) {
+	if id == "" {
+		id = getSession()
+	}
+
+	t := &Timer{
+		Id:     id,
+		Rule:   rule,
+		Action: action,
+		Due:    time.Now().Add(d),
+	}
+
+	b, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+
+	m.tlock.Lock()
+	defer m.tlock.Unlock()
+
+	if err := GetStore().Set(timerPrefix+id, string(b)); err != nil {
+		return nil, err
+	}
+	if old, ok := m.timers[id]; ok {
+		old.timer.Stop()
+	}
+	m.start(t)
+	return t, nil
+}
+
+// starts the timer, has to be called with the timer lock held
+func (m *RuleManager) start(t *Timer) {
+	m.timers[t.Id] = t
+	t.timer = time.AfterFunc(t.Due.Sub(time.Now()), func() {
+		m.fire(t)
+	})
+}
+
+// removes the timer and evaluates its action
+func (m *RuleManager) fire(t *Timer) {
+	m.tlock.Lock()
+	if m.timers[t.Id] != t {
+		// the timer has been cancelled or replaced in the meantime
+		m.tlock.Unlock()
+		return
+	}
+	delete(m.timers, t.Id)
+	err := GetStore().Delete(timerPrefix + t.Id)
+	m.tlock.Unlock()
+	if err != nil && err != ErrNotFound {
+		log.Printf("unable to remove timer '%s': %s\n", t.Id, err.Error())
+	}
+
+	session := getSession()
+	rule, err := m.Rule(t.Rule)
+	if err != nil || !rule.Enabled {
+		log.Printf("[%s] dropping timer '%s', rule '%s' is not loaded\n", session, t.Id, t.Rule)
+		return
+	}
+
+	if err := rule.eval(session, fmt.Sprintf("%s[%s]", rule.File, t.Id), t.Action); err != nil {
+		log.Printf("[%s] error in timer '%s' of '%s': %s\n", session, t.Id, rule.Name, err.Error())
+	} else {
+		log.Printf("[%s] executed timer '%s' of '%s'\n", session, t.Id, rule.Name)
+	}
+}
+
+// CancelTimer stops the timer with the given id
+func (m *RuleManager) CancelTimer(id string) error {
+	m.tlock.Lock()
+	defer m.tlock.Unlock()
+
+	t, ok := m.timers[id]
+	if !ok {
+		return ErrTimerNotFound
+	}
+
+	t.timer.Stop()
+	delete(m.timers, id)
+	if err := GetStore().Delete(timerPrefix + id); err != nil && err != ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// Timers returns all pending timers, ordered by the time they are due
+func (m *RuleManager) Timers() []*Timer {
+	m.tlock.Lock()
+	defer m.tlock.Unlock()
+
+	timers := []*Timer{}
+	for _, t := range m.timers {
+		timers = append(timers, t)
+	}
+	sort.Sort(byDue(timers))
+	return timers
+}
+
+// starts the timers kept in the store, timers that became due while we
+// were not running are fired right away
+func (m *RuleManager) restoreTimers() error {
+	values, err := GetStore().Scan(timerPrefix)
+	if err != nil {
+		return err
+	}
+
+	m.tlock.Lock()
+	defer m.tlock.Unlock()
+
+	for key, value := range values {
+		t := &Timer{}
+		if err := json.Unmarshal([]byte(value), t); err != nil {
+			log.Printf("unable to restore timer '%s': %s\n", key, err.Error())
+			continue
+		}
+		m.start(t)
+	}
+	if len(values) > 0 {
+		log.Printf("restored %d timers\n", len(values))
+	}
+	return nil
+}
+
+// evaluates code in the scope of the rule, without the state of the
+// rule's program (used for the actions of timers)
+func (r *Rule) eval(session, name, code string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.isClosed() {
+		return ErrRuleClosed
+	}
+
+	fset := twik.NewFileSet()
+	node, err := twik.Parse(fset, name, []byte(code))
+	if err != nil {
+		return err
+	}
+
+	scope := newGlobalScope(fset, r, code)
+	scope.session = session
+	scope.captures = captures(node)
+	_, err = scope.Eval(node)
+	return err
+}
+
+// "after" evaluates the action once the given duration has passed and
+// returns the id of the timer. The timer can be given an id, which
+// replaces a pending timer with the same id (e.g. to restart it).
+func (s *GlobalScope) afterFn(scope twik.Scope, args []ast.Node) (interface{}, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, errors.New(`function "after" takes two or three arguments`)
+	}
+
+	id := ""
+	if len(args) == 3 {
+		value, err := scope.Eval(args[0])
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if id, ok = value.(string); !ok || id == "" {
+			return nil, errors.New(`function "after" takes a name as first argument`)
+		}
+		args = args[1:]
+	}
+
+	value, err := scope.Eval(args[0])
+	if err != nil {
+		return nil, err
+	}
+	text, ok := value.(string)
+	if !ok {
+		return nil, errors.New(`function "after" takes a duration (e.g. "10m")`)
+	}
+	d, err := time.ParseDuration(text)
+	if err != nil {
+		return nil, err
+	}
+
+	m := GetRuleManager()
+	if m == nil {
+		return nil, errors.New("no rule manager to run timers")
+	}
+
+	// the action is kept as source code, so it can be stored. The local
+	// names it uses are bound to their current values in front of it.
+	action := s.source[args[1].Pos()-1 : args[1].End()-1]
+	if names := s.captures[args[1].Pos()]; len(names) > 0 {
+		bindings := []string{}
+		for _, name := range names {
+			value, err := scope.Get(name)
+			if err != nil {
+				return nil, err
+			}
+			text, err := literal(value)
+			if err != nil {
+				return nil, fmt.Errorf(`function "after" can not keep '%s' for later: %s`, name, err.Error())
+			}
+			bindings = append(bindings, fmt.Sprintf("(var %s %s)", name, text))
+		}
+		action = fmt.Sprintf("(do %s %s)", strings.Join(bindings, " "), action)
+	}
+	t, err := m.After(id, s.rule.File, d, action)
+	if err != nil {
+		return nil, err
+	}
+	return t.Id, nil
+}
+
+// "cancel-timer" stops the timer with the given id, returns whether the
+// timer has still been pending
+func cancelTimerFn(args []interface{}) (interface{}, error) {
+	if len(args) == 1 {
+		if id, ok := args[0].(string); ok {
+			m := GetRuleManager()
+			if m == nil {
+				return nil, errors.New("no rule manager to run timers")
+			}
+			err := m.CancelTimer(id)
+			if err == ErrTimerNotFound {
+				return false, nil
+			}
+			return err == nil, err
+		}
+	}
+	return nil, errors.New("cancel-timer function takes a single string argument")
+}
+
+// returns the value as source code, which evaluates to the same value
+func literal(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "nil", nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case int:
+		// the index of "range"
+		return strconv.Itoa(v), nil
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			break
+		}
+		// floats are only parsed as such if they have a dot
+		text := strconv.FormatFloat(v, 'f', -1, 64)
+		if !strings.Contains(text, ".") {
+			text += ".0"
+		}
+		return text, nil
+	case string:
+		// twik does not see the end of strings ending in a backslash
+		return strings.Replace(strconv.Quote(v), `\\`, `\x5c`, -1), nil
+	case []interface{}:
+		items := []string{"list"}
+		for _, item := range v {
+			text, err := literal(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, text)
+		}
+		return "(" + strings.Join(items, " ") + ")", nil
+	case map[string]interface{}:
+		keys := []string{}
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		items := []string{"object"}
+		for _, key := range keys {
+			text, err := literal(v[key])
+			if err != nil {
+				return "", err
+			}
+			items = append(items, strings.Replace(strconv.Quote(key), `\\`, `\x5c`, -1), text)
+		}
+		return "(" + strings.Join(items, " ") + ")", nil
+	}
+	return "", fmt.Errorf("%T can not be stored", value)
+}
@@ -0,0 +1,171 @@
+package gifttt
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/drtoful/gifttt/Godeps/_workspace/src/github.com/drtoful/twik"
+)
+
+func TestLiteral(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		text  string
+	}{
+		{nil, "nil"},
+		{true, "true"},
+		{int64(-42), "-42"},
+		{1.5, "1.5"},
+		{float64(2), "2.0"},
+		{"on", `"on"`},
+		{"a \"b\"\n", `"a \"b\"\n"`},
+		{`c:\`, `"c:\x5c"`},
+		{[]interface{}{int64(1), "a", []interface{}{}}, `(list 1 "a" (list))`},
+		{map[string]interface{}{"b": int64(2), "a": nil}, `(object "a" nil "b" 2)`},
+	}
+	for _, test := range tests {
+		text, err := literal(test.value)
+		if err != nil || text != test.text {
+			t.Errorf("literal(%#v) = %s (%v), expected %s", test.value, text, err, test.text)
+			continue
+		}
+
+		// evaluating the text gives the value again
+		fset := twik.NewFileSet()
+		node, err := twik.Parse(fset, "literal", []byte(text))
+		if err != nil {
+			t.Errorf("unable to parse %s: %s", text, err.Error())
+			continue
+		}
+		value, err := (&GlobalScope{fset: fset}).Eval(node)
+		if err != nil || !reflect.DeepEqual(value, test.value) {
+			t.Errorf("%s evaluates to %#v (%v), expected %#v", text, value, err, test.value)
+		}
+	}
+
+	for _, value := range []interface{}{1.0 / zero, func() {}, int32(1)} {
+		if text, err := literal(value); err == nil {
+			t.Errorf("literal(%#v) = %s, expected an error", value, text)
+		}
+	}
+}
+
+var zero = 0.0
+
+func TestCaptures(t *testing.T) {
+	tests := []struct {
+		source string
+		names  []string
+	}{
+		{`(after "1s" (set y x))`, []string{}},
+		{`(var x 1) (after "1s" (set y x))`, []string{"x"}},
+		{`(var x 1) (after "1s" (set x 2))`, []string{"x"}},
+		{`(var x 1) (after "1s" (do (var x 2) (set y x)))`, []string{}},
+		{`(var x 1) (var id "a") (after id "1s" (set y x))`, []string{"x"}},
+		{`(func f (a) (after "1s" (set y a)))`, []string{"a"}},
+		{`(range i (list 1 2) (after "1s" (log i)))`, []string{"i"}},
+		{`(var x 1) (after "1s" (after "1s" (set y x)))`, []string{"x"}},
+	}
+	for _, test := range tests {
+		fset := twik.NewFileSet()
+		node, err := twik.Parse(fset, "test.rule", []byte(test.source))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names := []string{}
+		for _, captured := range captures(node) {
+			for _, name := range captured {
+				if !contains(names, name) {
+					names = append(names, name)
+				}
+			}
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, test.names) {
+			t.Errorf("%s captures %v, expected %v", test.source, names, test.names)
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAfter(t *testing.T) {
+	defer testStore(t)()
+	m, cleanup := testRuleManager(t)
+	defer cleanup()
+
+	tests := []struct {
+		source string
+		result interface{}
+	}{
+		{`(set z 1) (after "10ms" (set result z))`, int64(1)},
+		{`(var x 42) (after "10ms" (set result x))`, int64(42)},
+		{`(var x (list 1 "a")) (after "10ms" (set result x))`, []interface{}{int64(1), "a"}},
+		{`(range (i v) (list 3) (after "10ms" (set result (+ i v))))`, int64(3)},
+		{`(var x 1) (after "10ms" (after "10ms" (set result (+ x 1))))`, int64(2)},
+		{`(var x 1) (after "10ms" (do (set x 5) (set result x)))`, int64(5)},
+	}
+	for i, test := range tests {
+		name := fmt.Sprintf("after%d.rule", i)
+		if err := m.Put(name, []byte(test.source)); err != nil {
+			t.Fatal(err)
+		}
+		rule, _ := m.Rule(name)
+		if err := rule.Run("test", nil); err != nil {
+			t.Fatalf("%s: %s", test.source, err.Error())
+		}
+		waitFor(t, "result", test.result)
+		if err := GetManager().Set("result", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the local x is not written to the variable x
+	if x, _ := GetManager().Get("x"); x != nil {
+		t.Errorf("x = %#v, expected nil", x)
+	}
+
+	if err := m.Put("func.rule", []byte(`(func f () 1) (after "10ms" (set result (f)))`)); err != nil {
+		t.Fatal(err)
+	}
+	rule, _ := m.Rule("func.rule")
+	if err := rule.Run("test", nil); err == nil {
+		t.Error("after kept a local function")
+	}
+	if len(m.Timers()) != 0 {
+		t.Errorf("%d timers pending", len(m.Timers()))
+	}
+}
+
+func TestCancelTimer(t *testing.T) {
+	defer testStore(t)()
+
+	// there is no rule manager
+	if err := runRule(t, `(cancel-timer "a")`); err == nil {
+		t.Error("cancel-timer without a rule manager did not fail")
+	}
+
+	m, cleanup := testRuleManager(t)
+	defer cleanup()
+	if _, err := m.After("a", "none.rule", time.Minute, `(set result 1)`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runRule(t, `(set result (list (cancel-timer "a") (cancel-timer "a")))`); err != nil {
+		t.Fatal(err)
+	}
+	if result, _ := GetManager().Get("result"); !reflect.DeepEqual(result, []interface{}{true, false}) {
+		t.Errorf("cancel-timer returned %v", result)
+	}
+}
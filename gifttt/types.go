@@ -0,0 +1,259 @@
+package gifttt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	typePrefix = "type~"
+
+	TypeInt    = "int"
+	TypeFloat  = "float"
+	TypeBool   = "bool"
+	TypeString = "string"
+	TypeList   = "list"
+)
+
+// A Type restricts the values of a variable. Values that don't match
+// are rejected, unless Coerce is set and they can be converted.
+type Type struct {
+	Type string `json:"type"`
+	// the range of numbers, if set
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+	// the values allowed, if set
+	Enum   []interface{} `json:"enum,omitempty"`
+	Coerce bool          `json:"coerce"`
+}
+
+// returns the value as the type, numbers are always converted between
+// int and float as long as they don't lose precision (JSON only knows
+// floats). Other conversions are only done if coerce is set.
+func (t *Type) convert(value interface{}, coerce bool) (interface{}, bool) {
+	switch t.Type {
+	case TypeInt:
+		switch v := value.(type) {
+		case int64:
+			return v, true
+		case float64:
+			if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+				return int64(v), true
+			}
+		case string:
+			if i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+				return i, coerce
+			}
+		case bool:
+			if v {
+				return int64(1), coerce
+			}
+			return int64(0), coerce
+		}
+	case TypeFloat:
+		switch v := value.(type) {
+		case float64:
+			return v, true
+		case int64:
+			return float64(v), true
+		case string:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				return f, coerce
+			}
+		}
+	case TypeBool:
+		switch v := value.(type) {
+		case bool:
+			return v, true
+		case string:
+			switch strings.ToLower(strings.TrimSpace(v)) {
+			case "true", "on", "yes", "1":
+				return true, coerce
+			case "false", "off", "no", "0":
+				return false, coerce
+			}
+		case int64:
+			return v != 0, coerce
+		case float64:
+			return v != 0, coerce
+		}
+	case TypeString:
+		switch v := value.(type) {
+		case string:
+			return v, true
+		case int64:
+			return strconv.FormatInt(v, 10), coerce
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), coerce
+		case bool:
+			return strconv.FormatBool(v), coerce
+		}
+	case TypeList:
+		if v, ok := value.([]interface{}); ok {
+			return v, true
+		}
+		if coerce && value != nil {
+			return []interface{}{value}, true
+		}
+	}
+	return nil, false
+}
+
+// returns the value converted to the type, or an error if it does not
+// match the type
+func (t *Type) check(name string, value interface{}) (interface{}, error) {
+	v, ok := t.convert(value, t.Coerce)
+	if !ok {
+		b, _ := json.Marshal(value)
+		return nil, fmt.Errorf("value %s of '%s' is not of type %s", string(b), name, t.Type)
+	}
+
+	var f float64
+	switch n := v.(type) {
+	case int64:
+		f = float64(n)
+	case float64:
+		f = n
+	}
+	if t.Min != nil && f < *t.Min {
+		return nil, fmt.Errorf("value %v of '%s' is less than %v", v, name, *t.Min)
+	}
+	if t.Max != nil && f > *t.Max {
+		return nil, fmt.Errorf("value %v of '%s' is greater than %v", v, name, *t.Max)
+	}
+
+	if t.Enum != nil {
+		for _, e := range t.Enum {
+			if reflect.DeepEqual(e, v) {
+				return v, nil
+			}
+		}
+		b, _ := json.Marshal(v)
+		return nil, fmt.Errorf("value %s of '%s' is not one of the allowed values", string(b), name)
+	}
+	return v, nil
+}
+
+// checks that the type is valid, and converts the values of the enum to
+// the type
+func (t *Type) validate() error {
+	switch t.Type {
+	case TypeInt, TypeFloat:
+	case TypeBool, TypeString, TypeList:
+		if t.Min != nil || t.Max != nil {
+			return fmt.Errorf("type %s can not have a range", t.Type)
+		}
+	default:
+		return fmt.Errorf("unknown type '%s' (int, float, bool, string or list)", t.Type)
+	}
+
+	if t.Min != nil && t.Max != nil && *t.Min > *t.Max {
+		return errors.New("min can not be greater than max")
+	}
+
+	for i, e := range t.Enum {
+		v, ok := t.convert(e, false)
+		if !ok {
+			return fmt.Errorf("enum value %v is not of type %s", e, t.Type)
+		}
+		t.Enum[i] = v
+	}
+	return nil
+}
+
+// returns the type of a variable, nil if it has none. Has to be called
+// with the lock held.
+func (vm *VariableManager) getType(name string) (*Type, error) {
+	if t, ok := vm.types[name]; ok {
+		return t, nil
+	}
+
+	store := GetStore()
+	b, err := store.Get(typePrefix + name)
+	if err == ErrNotFound {
+		vm.types[name] = nil
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	t := &Type{}
+	if err := json.Unmarshal([]byte(b), t); err != nil {
+		return nil, err
+	}
+	// the values of the enum are decoded from JSON again
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	vm.types[name] = t
+	return t, nil
+}
+
+// returns the type of a variable, nil if it has none
+func (vm *VariableManager) Type(name string) (*Type, error) {
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+	return vm.getType(name)
+}
+
+// sets the type of a variable, nil removes it. The current value of the
+// variable has to match the new type and is converted to it.
+func (vm *VariableManager) SetType(name string, t *Type) error {
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+
+	store := GetStore()
+	if t == nil {
+		if err := store.Delete(typePrefix + name); err != nil && err != ErrNotFound {
+			return err
+		}
+		vm.types[name] = nil
+		return nil
+	}
+
+	if err := t.validate(); err != nil {
+		return err
+	}
+
+	// the current value has to match the new type, it is converted to it
+	// without triggering any rules
+	value, err := vm.get(name)
+	if err != nil {
+		return err
+	}
+	var converted *Value
+	if value != nil {
+		if value, err = t.check(name, value); err != nil {
+			return err
+		}
+		v := *vm.cache[name]
+		v.Value = value
+		converted = &v
+	}
+
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if err := store.Set(typePrefix+name, string(b)); err != nil {
+		return err
+	}
+	vm.types[name] = t
+
+	if converted != nil {
+		b, err := json.Marshal(converted)
+		if err != nil {
+			return err
+		}
+		if err := store.Set(varPrefix+name, string(b)); err != nil {
+			return err
+		}
+		vm.cache[name] = converted
+	}
+	return nil
+}
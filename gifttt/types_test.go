@@ -0,0 +1,171 @@
+package gifttt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func float(f float64) *float64 {
+	return &f
+}
+
+func TestTypeCheck(t *testing.T) {
+	tests := []struct {
+		t      Type
+		value  interface{}
+		result interface{}
+		ok     bool
+	}{
+		{Type{Type: TypeInt}, int64(1), int64(1), true},
+		{Type{Type: TypeInt}, 1.0, int64(1), true},
+		{Type{Type: TypeInt}, 1.5, nil, false},
+		{Type{Type: TypeInt}, "1", nil, false},
+		{Type{Type: TypeInt, Coerce: true}, " 1 ", int64(1), true},
+		{Type{Type: TypeInt, Coerce: true}, true, int64(1), true},
+		{Type{Type: TypeInt, Min: float(0), Max: float(10)}, int64(11), nil, false},
+		{Type{Type: TypeInt, Min: float(0), Max: float(10)}, int64(-1), nil, false},
+		{Type{Type: TypeInt, Min: float(0), Max: float(10)}, int64(10), int64(10), true},
+		{Type{Type: TypeFloat}, int64(2), 2.0, true},
+		{Type{Type: TypeFloat}, "2.5", nil, false},
+		{Type{Type: TypeFloat, Coerce: true}, "2.5", 2.5, true},
+		{Type{Type: TypeBool}, true, true, true},
+		{Type{Type: TypeBool}, "on", nil, false},
+		{Type{Type: TypeBool, Coerce: true}, "on", true, true},
+		{Type{Type: TypeBool, Coerce: true}, "Off", false, true},
+		{Type{Type: TypeBool, Coerce: true}, "maybe", nil, false},
+		{Type{Type: TypeString}, "a", "a", true},
+		{Type{Type: TypeString}, int64(1), nil, false},
+		{Type{Type: TypeString, Coerce: true}, 1.5, "1.5", true},
+		{Type{Type: TypeString, Enum: []interface{}{"on", "off"}}, "on", "on", true},
+		{Type{Type: TypeString, Enum: []interface{}{"on", "off"}}, "dim", nil, false},
+		{Type{Type: TypeList}, []interface{}{int64(1)}, []interface{}{int64(1)}, true},
+		{Type{Type: TypeList}, int64(1), nil, false},
+		{Type{Type: TypeList, Coerce: true}, int64(1), []interface{}{int64(1)}, true},
+	}
+	for _, test := range tests {
+		if err := test.t.validate(); err != nil {
+			t.Fatalf("%+v: %s", test.t, err.Error())
+		}
+		result, err := test.t.check("x", test.value)
+		if (err == nil) != test.ok || !reflect.DeepEqual(result, test.result) {
+			t.Errorf("%+v check(%#v) = %#v (%v), expected %#v", test.t, test.value, result, err, test.result)
+		}
+	}
+}
+
+func TestTypeValidate(t *testing.T) {
+	tests := []struct {
+		t  Type
+		ok bool
+	}{
+		{Type{Type: TypeInt, Min: float(1), Max: float(1)}, true},
+		{Type{Type: TypeInt, Min: float(2), Max: float(1)}, false},
+		{Type{Type: TypeString, Min: float(1)}, false},
+		{Type{Type: "number"}, false},
+		{Type{Type: TypeInt, Enum: []interface{}{1.0, 2.0}}, true},
+		{Type{Type: TypeInt, Enum: []interface{}{1.5}}, false},
+		{Type{Type: TypeBool, Enum: []interface{}{"on"}}, false},
+	}
+	for _, test := range tests {
+		if err := test.t.validate(); (err == nil) != test.ok {
+			t.Errorf("%+v validate() = %v", test.t, err)
+		}
+	}
+}
+
+func TestSetType(t *testing.T) {
+	defer testStore(t)()
+	vm := GetManager()
+
+	if err := vm.SetType("level", &Type{Type: TypeInt, Max: float(10)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Set("level", 11.0); err == nil {
+		t.Error("value greater than max has been set")
+	}
+	if err := vm.Set("level", 5.0); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := vm.Get("level"); v != int64(5) {
+		t.Errorf("level = %#v, expected 5", v)
+	}
+
+	// the current value has to match the new type
+	if err := vm.SetType("level", &Type{Type: TypeInt, Max: float(4)}); err == nil {
+		t.Error("type has been set although the value does not match it")
+	}
+	if tp, _ := vm.Type("level"); tp == nil || *tp.Max != 10 {
+		t.Errorf("type of level is %+v", tp)
+	}
+
+	if err := vm.SetType("level", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Set("level", "high"); err != nil {
+		t.Errorf("unable to set level without a type: %s", err.Error())
+	}
+}
+
+func TestSetTypeConverts(t *testing.T) {
+	defer testStore(t)()
+	vm := GetManager()
+
+	if err := vm.Set("count", 1.0); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Set("temp", "21"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.SetType("count", &Type{Type: TypeInt}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.SetType("temp", &Type{Type: TypeInt}); err == nil {
+		t.Error("string has been accepted as int without coerce")
+	}
+	if err := vm.SetType("temp", &Type{Type: TypeInt, Coerce: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i += 1 {
+		if v, _ := vm.Get("count"); v != int64(1) {
+			t.Errorf("count = %#v, expected 1", v)
+		}
+		if v, _ := vm.Get("temp"); v != int64(21) {
+			t.Errorf("temp = %#v, expected 21", v)
+		}
+
+		// the converted values have been stored as well
+		vm.lock.Lock()
+		vm.cache = make(map[string]*Value)
+		vm.types = make(map[string]*Type)
+		vm.lock.Unlock()
+	}
+}
+
+func TestDeleteType(t *testing.T) {
+	defer testStore(t)()
+	vm := GetManager()
+
+	// a variable that has never been set can have a type, which is
+	// removed together with it
+	if err := vm.SetType("mode", &Type{Type: TypeString}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Delete("mode"); err != nil {
+		t.Fatal(err)
+	}
+	if tp, err := vm.Type("mode"); tp != nil || err != nil {
+		t.Errorf("type of mode is %+v (%v) after deleting it", tp, err)
+	}
+	if err := vm.Set("mode", int64(1)); err != nil {
+		t.Errorf("type still applies after deleting mode: %s", err.Error())
+	}
+
+	if err := vm.Delete("mode"); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Delete("mode"); err != ErrNotFound {
+		t.Errorf("deleting mode twice returned %v", err)
+	}
+}
@@ -0,0 +1,360 @@
+package gifttt
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	_manager     *VariableManager
+	_managerOnce sync.Once
+	varPrefix    = "var~"
+)
+
+const (
+	// the origin of the changes made by rules
+	ruleOrigin = "rule"
+)
+
+// The VariableManager is shared by the API, the rule manager and all
+// running rules. All access to the cache (and writes to the store) are
+// serialized by lock, so that checking for a change and writing the new
+// value happen as one step. Subscribers are kept separately, so that
+// subscribing does not have to wait for a pending change.
+//
+// Every change is added to Events, from where the rule manager takes
+// them to trigger the rules.
+type VariableManager struct {
+	Events   *EventQueue
+	lock     *sync.Mutex
+	cache    map[string]*Value
+	previous map[string]*Value
+	// the types of variables, nil if a variable has none
+	types       map[string]*Type
+	retention   Retention
+	subLock     *sync.RWMutex
+	subscribers map[*Subscription]bool
+}
+
+type Value struct {
+	Name  string      `json:"-"`
+	Value interface{} `json:"value"`
+	// the number of changes caused by rules that led to this one
+	Depth int `json:"-"`
+	// who made the change, if it was not the API
+	origin string
+}
+
+func GetManager() *VariableManager {
+	_managerOnce.Do(func() {
+		events, _ := NewEventQueue(DefaultQueueSize, PolicyBlock)
+		_manager = &VariableManager{
+			Events:      events,
+			lock:        &sync.Mutex{},
+			cache:       make(map[string]*Value),
+			previous:    make(map[string]*Value),
+			types:       make(map[string]*Type),
+			subLock:     &sync.RWMutex{},
+			subscribers: make(map[*Subscription]bool),
+		}
+	})
+	return _manager
+}
+
+// returns the current value of a variable, has to be called with the
+// lock held
+func (vm *VariableManager) get(name string) (interface{}, error) {
+	// check cache first
+	if v, ok := vm.cache[name]; ok {
+		return v.Value, nil
+	}
+
+	store := GetStore()
+	b, err := store.Get(varPrefix + name)
+	if err != nil {
+		return nil, nil
+	}
+
+	v := &Value{Name: name}
+	if err := json.Unmarshal([]byte(b), v); err != nil {
+		return nil, err
+	}
+
+	// JSON turns all numbers into floats
+	if t, err := vm.getType(name); err != nil {
+		return nil, err
+	} else if t != nil {
+		if value, ok := t.convert(v.Value, false); ok {
+			v.Value = value
+		}
+	}
+	vm.cache[name] = v
+	return v.Value, nil
+}
+
+func (vm *VariableManager) Get(name string) (interface{}, error) {
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+	return vm.get(name)
+}
+
+// sets the variable to the value of v if check returns true for its
+// current value. Returns whether the check succeeded. The change is only
+// written (and published) if the value actually differs from the current
+// one.
+func (vm *VariableManager) swap(v *Value, check func(old interface{}, err error) bool) (bool, error) {
+	// wait for room in the queue before taking the lock, so that a full
+	// queue does not hold up everyone else. Changes made by rules can not
+	// wait (even if they have not been triggered by a change, e.g. in a
+	// timer), as the rules themselves are what empties the queue.
+	if v.origin != ruleOrigin {
+		vm.Events.Wait(v.Name)
+	}
+
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+
+	t, err := vm.getType(v.Name)
+	if err != nil {
+		return false, err
+	}
+	if t != nil {
+		if v.Value, err = t.check(v.Name, v.Value); err != nil {
+			return false, err
+		}
+	}
+
+	old, err := vm.get(v.Name)
+	if !check(old, err) {
+		return false, nil
+	}
+	if err == nil && reflect.DeepEqual(old, v.Value) {
+		return true, nil
+	}
+
+	if err := vm.write(v, time.Now()); err != nil {
+		return false, err
+	}
+	if prev, ok := vm.cache[v.Name]; ok {
+		vm.previous[v.Name] = prev
+	}
+	vm.cache[v.Name] = v
+
+	// the change is published while still holding the lock, so that
+	// subscribers see changes in the same order as they have been
+	// written. Neither the queue nor the subscribers block.
+	vm.publish(v)
+	return true, nil
+}
+
+func (vm *VariableManager) Set(name string, value interface{}) error {
+	_, err := vm.swap(&Value{Name: name, Value: value}, func(interface{}, error) bool {
+		return true
+	})
+	return err
+}
+
+// same as Set, for changes made by a rule. Depth is the number of changes
+// made by rules that led to this one (0 if the rule has not been
+// triggered by a change).
+func (vm *VariableManager) cascade(name string, value interface{}, depth int) error {
+	_, err := vm.swap(&Value{Name: name, Value: value, Depth: depth, origin: ruleOrigin}, func(interface{}, error) bool {
+		return true
+	})
+	return err
+}
+
+// same as Set, the change is marked with the origin so that subscribers
+// can tell which changes they made themselves
+func (vm *VariableManager) setFrom(origin, name string, value interface{}) error {
+	_, err := vm.swap(&Value{Name: name, Value: value, origin: origin}, func(interface{}, error) bool {
+		return true
+	})
+	return err
+}
+
+// returns the value a variable had before its last change (since gifttt
+// has been started)
+func (vm *VariableManager) Previous(name string) interface{} {
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+
+	if v, ok := vm.previous[name]; ok {
+		return v.Value
+	}
+	return nil
+}
+
+// CompareAndSet sets the variable to value only if it currently has the
+// value old. Returns whether the variable had the value old.
+func (vm *VariableManager) CompareAndSet(name string, old, value interface{}) (bool, error) {
+	return vm.swap(&Value{Name: name, Value: value}, func(current interface{}, err error) bool {
+		return err == nil && reflect.DeepEqual(current, old)
+	})
+}
+
+// A Subscription receives the changes of variables. Publishing a change
+// never waits for a subscriber: if it does not keep up, further changes
+// are dropped until it has taken the pending ones. A coalescing
+// subscription instead only keeps the latest change of every variable,
+// so that it never misses the current value.
+type Subscription struct {
+	// receives a value whenever there are changes to take
+	Ready    chan bool
+	lock     *sync.Mutex
+	changes  []*Value
+	size     int
+	coalesce bool
+	// the number of changes dropped since the last Take
+	dropped int
+}
+
+// adds a change, returns false if it had to be dropped
+func (s *Subscription) add(v *Value) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	added := false
+	if s.coalesce {
+		for i, c := range s.changes {
+			if c.Name == v.Name {
+				s.changes[i] = v
+				added = true
+				break
+			}
+		}
+	}
+	if !added {
+		if !s.coalesce && len(s.changes) >= s.size {
+			s.dropped += 1
+			return false
+		}
+		s.changes = append(s.changes, v)
+	}
+
+	select {
+	case s.Ready <- true:
+	default:
+	}
+	return true
+}
+
+// Take returns the pending changes in the order they happened, and the
+// number of changes that have been dropped since the last call
+func (s *Subscription) Take() ([]*Value, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	changes, dropped := s.changes, s.dropped
+	s.changes, s.dropped = nil, 0
+	return changes, dropped
+}
+
+func (vm *VariableManager) subscribe(s *Subscription) *Subscription {
+	vm.subLock.Lock()
+	defer vm.subLock.Unlock()
+	vm.subscribers[s] = true
+	return s
+}
+
+// Subscribe returns a subscription that keeps up to size changes until
+// they are taken
+func (vm *VariableManager) Subscribe(size int) *Subscription {
+	return vm.subscribe(&Subscription{
+		Ready: make(chan bool, 1),
+		lock:  &sync.Mutex{},
+		size:  size,
+	})
+}
+
+// SubscribeLatest returns a coalescing subscription, that keeps the latest
+// change of every variable until it is taken
+func (vm *VariableManager) SubscribeLatest() *Subscription {
+	return vm.subscribe(&Subscription{
+		Ready:    make(chan bool, 1),
+		lock:     &sync.Mutex{},
+		coalesce: true,
+	})
+}
+
+// Unsubscribe stops sending changes to the subscription and closes its
+// Ready channel
+func (vm *VariableManager) Unsubscribe(s *Subscription) {
+	vm.subLock.Lock()
+	defer vm.subLock.Unlock()
+	if _, ok := vm.subscribers[s]; ok {
+		delete(vm.subscribers, s)
+		close(s.Ready)
+	}
+}
+
+func (vm *VariableManager) publish(v *Value) {
+	vm.Events.Push(v)
+
+	vm.subLock.RLock()
+	defer vm.subLock.RUnlock()
+
+	for s := range vm.subscribers {
+		s.add(v)
+	}
+}
+
+// returns the values of all variables whose name starts with the given prefix
+func (vm *VariableManager) List(prefix string) (map[string]interface{}, error) {
+	store := GetStore()
+	values, err := store.Scan(varPrefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]interface{})
+	for k, b := range values {
+		v := &Value{}
+		if err := json.Unmarshal([]byte(b), v); err != nil {
+			return nil, err
+		}
+		result[strings.TrimPrefix(k, varPrefix)] = v.Value
+	}
+	return result, nil
+}
+
+// removes a variable completely, this will not trigger any rules. A
+// variable without a value can still have a type or a retention, which
+// are removed as well. Returns ErrNotFound if there was nothing to remove.
+func (vm *VariableManager) Delete(name string) error {
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+
+	store := GetStore()
+	found := true
+	if err := store.Delete(varPrefix + name); err == ErrNotFound {
+		found = false
+	} else if err != nil {
+		return err
+	}
+	if err := store.DeleteHistory(name); err != nil {
+		return err
+	}
+	if _, err := store.Get(retentionPrefix + name); err == nil {
+		found = true
+	}
+	if err := vm.SetRetention(name, nil); err != nil {
+		return err
+	}
+	if err := store.Delete(typePrefix + name); err == nil {
+		found = true
+	} else if err != ErrNotFound {
+		return err
+	}
+
+	delete(vm.cache, name)
+	delete(vm.previous, name)
+	delete(vm.types, name)
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package gifttt
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentSetGet(t *testing.T) {
+	defer testStore(t)()
+	vm := GetManager()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i += 1 {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("var%d", i)
+			for j := 0; j < 50; j += 1 {
+				if err := vm.Set(name, int64(j)); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := vm.Set("shared", int64(j)); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := vm.Get("shared"); err != nil {
+					t.Error(err)
+					return
+				}
+				vm.Previous(name)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 8; i += 1 {
+		name := fmt.Sprintf("var%d", i)
+		if v, err := vm.Get(name); err != nil || v != int64(49) {
+			t.Errorf("%s = %v (%v), expected 49", name, v, err)
+		}
+		if v := vm.Previous(name); v != int64(48) {
+			t.Errorf("previous value of %s = %v, expected 48", name, v)
+		}
+	}
+}
+
+func TestCompareAndSet(t *testing.T) {
+	defer testStore(t)()
+	vm := GetManager()
+
+	// a variable that has not been set has the value nil
+	tests := []struct {
+		old, value interface{}
+		ok         bool
+		result     interface{}
+	}{
+		{int64(1), int64(2), false, nil},
+		{nil, int64(0), true, int64(0)},
+		{int64(1), int64(2), false, int64(0)},
+		{int64(0), int64(1), true, int64(1)},
+		{int64(1), int64(1), true, int64(1)},
+		{"1", int64(2), false, int64(1)},
+	}
+	for _, test := range tests {
+		ok, err := vm.CompareAndSet("cas", test.old, test.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != test.ok {
+			t.Errorf("CompareAndSet(%v, %v) = %v, expected %v", test.old, test.value, ok, test.ok)
+		}
+		if v, _ := vm.Get("cas"); v != test.result {
+			t.Errorf("after CompareAndSet(%v, %v) value is %v, expected %v", test.old, test.value, v, test.result)
+		}
+	}
+}
+
+// incrementing a counter with CompareAndSet from many goroutines must not
+// lose a single increment
+func TestConcurrentCompareAndSet(t *testing.T) {
+	defer testStore(t)()
+	vm := GetManager()
+
+	if err := vm.Set("counter", int64(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j += 1 {
+				for {
+					v, err := vm.Get("counter")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					ok, err := vm.CompareAndSet("counter", v, v.(int64)+1)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if ok {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v, _ := vm.Get("counter"); v != int64(200) {
+		t.Errorf("counter = %v, expected 200", v)
+	}
+}
+
+func TestSubscription(t *testing.T) {
+	defer testStore(t)()
+	vm := GetManager()
+
+	changes := vm.Subscribe(2)
+	latest := vm.SubscribeLatest()
+	for _, v := range []int64{1, 2, 3, 4} {
+		if err := vm.Set("a", v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := vm.Set("b", int64(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	values, dropped := changes.Take()
+	if len(values) != 2 || values[0].Value != int64(1) || values[1].Value != int64(2) || dropped != 3 {
+		t.Errorf("subscription took %v changes, dropped %d", values, dropped)
+	}
+	if values, dropped = changes.Take(); len(values) != 0 || dropped != 0 {
+		t.Errorf("subscription took %v changes, dropped %d after taking all", values, dropped)
+	}
+
+	values, dropped = latest.Take()
+	if len(values) != 2 || values[0].Value != int64(4) || values[1].Name != "b" || dropped != 0 {
+		t.Errorf("coalescing subscription took %v changes, dropped %d", values, dropped)
+	}
+
+	vm.Unsubscribe(changes)
+	vm.Unsubscribe(latest)
+	// ends once the pending notification has been received
+	for range changes.Ready {
+	}
+}
@@ -3,10 +3,12 @@ package main
 import (
 	"flag"
 	"log"
+	"math"
 	"os"
 	"os/signal"
 	"runtime/pprof"
 	"syscall"
+	"time"
 
 	"github.com/drtoful/gifttt/gifttt"
 )
@@ -18,12 +20,24 @@ func main() {
 		cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
 		apiBind    = flag.String("ip", "", "ip to bind the api server to")
 		apiPort    = flag.String("port", "4200", "port for api server")
+		histCount  = flag.Int("history-count", 1000, "number of values kept in the history of each variable (0 for no limit, if both limits are 0 no history is kept)")
+		histAge    = flag.Duration("history-age", 24*time.Hour, "how long values are kept in the history of each variable (0 for no limit, if both limits are 0 no history is kept)")
+		queueSize  = flag.Int("queue-size", gifttt.DefaultQueueSize, "number of variable changes waiting to be processed by rules")
+		queuePol   = flag.String("queue-policy", gifttt.PolicyBlock, "what to do with changes if the queue is full (block, drop-oldest or coalesce)")
+		maxCascade = flag.Int("max-cascade", gifttt.DefaultMaxCascade, "number of changes caused by rules in a row, before rules are no longer triggered (0 for no limit)")
+		parallel   = flag.Bool("parallel", false, "evaluate all rules triggered by a change at the same time")
+		reload     = flag.Duration("reload", 2*time.Second, "interval to check rule files for changes (0 to disable)")
+		latitude   = flag.Float64("latitude", 0, "latitude in degrees to compute the sun variables for (north is positive)")
+		longitude  = flag.Float64("longitude", 0, "longitude in degrees to compute the sun variables for (east is positive)")
+		mqttConfig = flag.String("mqtt", "", "path to a file configuring the bridge to a mqtt broker")
+		runPolicy  = flag.String("run-policy", "", "path to a file restricting the commands rules can execute (default no restrictions)")
+		timezone   = flag.String("timezone", "", "timezone for time variables and schedules, e.g. Europe/Zurich (default local time)")
 	)
 	flag.Parse()
 
 	// activate cpu profiling
 	if *cpuprofile != "" {
-		log.Println("main: Starting CPU profiling '%s'", *cpuprofile)
+		log.Printf("main: Starting CPU profiling '%s'\n", *cpuprofile)
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
 			log.Fatal(err)
@@ -36,17 +50,70 @@ func main() {
 		log.Fatal(err)
 	}
 
+	events, err := gifttt.NewEventQueue(*queueSize, *queuePol)
+	if err != nil {
+		log.Fatal(err)
+	}
+	gifttt.GetManager().Events = events
+
+	// the history is only kept if at least one of the limits is
+	// set, otherwise it would grow forever
+	gifttt.GetManager().SetDefaultRetention(gifttt.Retention{
+		Count: *histCount,
+		Age:   int64(histAge.Seconds()),
+	})
+
+	if *runPolicy != "" {
+		policy, err := gifttt.LoadRunPolicy(*runPolicy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		gifttt.SetRunPolicy(policy)
+	}
+
 	// start the servers
 	rm := gifttt.NewRuleManager(*rulePath)
+	rm.Parallel = *parallel
+	rm.MaxCascade = *maxCascade
+	if *timezone != "" {
+		loc, err := time.LoadLocation(*timezone)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rm.Location = loc
+	}
+
+	// the sun variables are only computed if we know where we are
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "latitude" || f.Name == "longitude" {
+			rm.Coordinates = &gifttt.Coordinates{
+				Latitude:  *latitude,
+				Longitude: *longitude,
+			}
+		}
+	})
+	if c := rm.Coordinates; c != nil && (math.Abs(c.Latitude) > 90 || math.Abs(c.Longitude) > 180) {
+		log.Fatal("invalid coordinates, latitude has to be within -90 and 90, longitude within -180 and 180")
+	}
 	api := gifttt.NewAPIServer(*apiBind, *apiPort)
 
 	go rm.Run()
 	go api.Run()
+	if *mqttConfig != "" {
+		config, err := gifttt.LoadMQTTConfig(*mqttConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go gifttt.NewMQTTBridge(config).Run()
+	}
+	if *reload > 0 {
+		go rm.Watch(*reload)
+	}
 
 	// all listeners are started in the background as
 	// gofunc's so we wait here for an interupt signal
 	// to stop the service gracefully
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	for {
 		select {